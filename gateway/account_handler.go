@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetPurpose     = "password_reset"
+	emailVerificationPurpose = "email_verification"
+
+	passwordResetExpiry     = time.Hour
+	emailVerificationExpiry = 48 * time.Hour
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// accountDeletes remove everything the user owns, children first as the
+// note tables do not cascade. Tokens, recovery codes, identities, API keys,
+// notebooks, jobs and note_files go with the users row.
+var accountDeletes = []string{
+	"DELETE FROM quiz_cards WHERE note_id IN (SELECT id FROM notes WHERE user_id = $1)",
+	"DELETE FROM ocr_blocks WHERE note_id IN (SELECT id FROM notes WHERE user_id = $1)",
+	"DELETE FROM audio_notes WHERE note_id IN (SELECT id FROM notes WHERE user_id = $1)",
+	"DELETE FROM tags WHERE note_id IN (SELECT id FROM notes WHERE user_id = $1)",
+	"DELETE FROM study_blocks WHERE user_id = $1",
+	"DELETE FROM notes WHERE user_id = $1",
+	"DELETE FROM sessions WHERE user_id = $1",
+	"DELETE FROM users WHERE id = $1",
+}
+
+// appBaseURL is where the frontend lives, from APP_BASE_URL
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return "http://localhost:5173"
+}
+
+// appURL builds a link into the frontend carrying a token
+func appURL(path, token string) string {
+	return appBaseURL() + path + "?token=" + url.QueryEscape(token)
+}
+
+// issueUserToken creates a single-use token for the user and stores its
+// digest. Earlier unused tokens for the same purpose are invalidated.
+func issueUserToken(userID, purpose string, expiry time.Duration) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE user_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID,
+		purpose,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userID,
+		purpose,
+		hashToken(token),
+		time.Now().Add(expiry),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// consumeUserToken marks an unexpired token as used and returns its user.
+// It returns sql.ErrNoRows for unknown, expired or already used tokens.
+func consumeUserToken(tx *sql.Tx, token, purpose string) (string, error) {
+	var userID string
+	err := tx.QueryRow(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(token), purpose).Scan(&userID)
+	return userID, err
+}
+
+// sendVerificationEmail mails a verification link for a new account
+func sendVerificationEmail(ctx context.Context, userID, email string) error {
+	token, err := issueUserToken(userID, emailVerificationPurpose, emailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, Message{
+		To:      email,
+		Subject: "Confirm your NeuroNote email",
+		Body: fmt.Sprintf(
+			"Welcome to NeuroNote!\n\nConfirm your email address by opening:\n%s\n\nThe link expires in %d hours.\n",
+			appURL("/verify-email", token),
+			int(emailVerificationExpiry.Hours()),
+		),
+	})
+}
+
+func forgotPassword(c *fiber.Ctx) error {
+	var req ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	email := normalizeEmail(req.Email)
+
+	// Answer the same way whether or not the account exists
+	accepted := fiber.Map{
+		"message": "If the account exists, a reset link has been sent",
+	}
+
+	var userID string
+	err := db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusAccepted).JSON(accepted)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	// Failures past this point are logged, not reported, since only an
+	// existing account gets this far
+	token, err := issueUserToken(userID, passwordResetPurpose, passwordResetExpiry)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create password reset token: %v", err)
+		return c.Status(fiber.StatusAccepted).JSON(accepted)
+	}
+
+	err = mailer.Send(c.Context(), Message{
+		To:      email,
+		Subject: "Reset your NeuroNote password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for this account.\n\nChoose a new password here:\n%s\n\nThe link expires in %d minutes. If this wasn't you, ignore this email.\n",
+			appURL("/reset-password", token),
+			int(passwordResetExpiry.Minutes()),
+		),
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to send password reset email: %v", err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(accepted)
+}
+
+func resetPassword(c *fiber.Ctx) error {
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired token",
+		})
+	}
+
+	// Check the new password before spending the token
+	if msg := passwordPolicy.validate(req.Password, ""); msg != "" {
+		return validationError(c, FieldErrors{"password": msg})
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, passwordResetPurpose)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify token",
+		})
+	}
+
+	// Receiving the email proves ownership of the address as well
+	_, err = tx.Exec(
+		"UPDATE users SET hashed_password = $1, email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $2",
+		string(hashedPassword),
+		userID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+
+	// Whoever knew the old password is logged out
+	if _, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func verifyEmail(c *fiber.Ctx) error {
+	var req VerifyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, emailVerificationPurpose)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify token",
+		})
+	}
+
+	_, err = tx.Exec("UPDATE users SET email_verified_at = NOW() WHERE id = $1", userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify email",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// deleteAccount removes the user and all of their data once they have
+// confirmed their password. Accounts created through single sign-on set
+// a password through the reset flow first.
+func deleteAccount(c *fiber.Ctx) error {
+	userID := currentUserID(c)
+
+	var req DeleteAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var email, hashedPassword string
+	err := db.QueryRow(
+		"SELECT email, hashed_password FROM users WHERE id = $1",
+		userID,
+	).Scan(&email, &hashedPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	// A stolen session must not be able to guess its way to deletion
+	ip := c.IP()
+	attempt, wait, err := loginLimiter.Reserve(c.Context(), email, ip)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check login attempts",
+		})
+	}
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many login attempts",
+		})
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid password",
+		})
+	}
+	releaseLoginAttempt(c, attempt)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	for _, query := range accountDeletes {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete account",
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	// The rows are gone, leftover files are only logged
+	if err := removeUploads(userID); err != nil {
+		log.Printf("[ERROR] Failed to remove uploads of deleted user %s: %v", userID, err)
+	}
+
+	clearSessionCookies(c)
+	return c.SendStatus(fiber.StatusNoContent)
+}
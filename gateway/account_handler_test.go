@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// expectIssueUserToken mocks issueUserToken, recording the stored digest
+func expectIssueUserToken(mock sqlmock.Sqlmock, userID, purpose string, digest *string) {
+	if digest == nil {
+		digest = new(string)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_tokens SET used_at = NOW\\(\\) WHERE user_id = \\$1").
+		WithArgs(userID, purpose).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").
+		WithArgs(userID, purpose, captureArg{digest}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// readOnlyMail returns the single message written by a logMailer
+func readOnlyMail(t *testing.T, dir string) string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	data, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	return string(data)
+}
+
+var linkToken = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+func TestForgotPassword_SendsResetLink(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	dir := t.TempDir()
+	mailer = &logMailer{dir: dir}
+	t.Setenv("APP_BASE_URL", "https://neuronote.test")
+	app.Post("/auth/password/forgot", forgotPassword)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE email = \\$1").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	var digest string
+	expectIssueUserToken(mock, "user-1", passwordResetPurpose, &digest)
+
+	req := httptest.NewRequest("POST", "/auth/password/forgot", strings.NewReader(`{"email":" Ada@Example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	mail := readOnlyMail(t, dir)
+	assert.Contains(t, mail, "To: ada@example.com\r\n")
+	assert.Contains(t, mail, "https://neuronote.test/reset-password?token=")
+
+	// The link carries the token, the database only its digest
+	match := linkToken.FindStringSubmatch(mail)
+	if assert.Len(t, match, 2) {
+		assert.Equal(t, hashToken(match[1]), digest)
+		assert.NotContains(t, digest, match[1])
+	}
+}
+
+func TestForgotPassword_UnknownEmail(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	dir := t.TempDir()
+	mailer = &logMailer{dir: dir}
+	app.Post("/auth/password/forgot", forgotPassword)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE email = \\$1").
+		WithArgs("nobody@example.com").
+		WillReturnError(sql.ErrNoRows)
+
+	req := httptest.NewRequest("POST", "/auth/password/forgot", strings.NewReader(`{"email":"nobody@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+
+	// Same answer as for a real account, but nothing is sent
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.Empty(t, files)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// failingMailer stands in for a mail relay that is down
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg Message) error {
+	return errors.New("connection refused")
+}
+
+func TestForgotPassword_MailFailure(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	mailer = failingMailer{}
+	t.Cleanup(func() { mailer = &logMailer{} })
+	app.Post("/auth/password/forgot", forgotPassword)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE email = \\$1").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	expectIssueUserToken(mock, "user-1", passwordResetPurpose, nil)
+
+	req := httptest.NewRequest("POST", "/auth/password/forgot", strings.NewReader(`{"email":"ada@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+
+	// An account whose mail failed looks like one that does not exist
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetPassword_Success(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/password/reset", resetPassword)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(hashToken("reset-token"), passwordResetPurpose).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+	mock.ExpectExec("UPDATE users SET hashed_password = \\$1").
+		WithArgs(sqlmock.AnyArg(), "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// Hashing the new password is slow under the race detector
+	req := httptest.NewRequest("POST", "/auth/password/reset", strings.NewReader(`{"token":"reset-token","password":"purple staple lecture"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetPassword_InvalidToken(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/password/reset", resetPassword)
+
+	// Unknown, expired and used tokens all fail the same UPDATE
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(hashToken("used-token"), passwordResetPurpose).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("POST", "/auth/password/reset", strings.NewReader(`{"token":"used-token","password":"purple staple lecture"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetPassword_WeakPasswordKeepsToken(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/password/reset", resetPassword)
+
+	req := httptest.NewRequest("POST", "/auth/password/reset", strings.NewReader(`{"token":"reset-token","password":"short"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var result struct {
+		Fields map[string]string `json:"fields"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "Password must be at least 8 characters", result.Fields["password"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyEmail(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/verify", verifyEmail)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(hashToken("verify-token"), emailVerificationPurpose).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+	mock.ExpectExec("UPDATE users SET email_verified_at = NOW\\(\\) WHERE id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/auth/verify", strings.NewReader(`{"token":"verify-token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyEmail_ResetTokenRejected(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/verify", verifyEmail)
+
+	// Tokens are bound to their purpose
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(hashToken("reset-token"), emailVerificationPurpose).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("POST", "/auth/verify", strings.NewReader(`{"token":"reset-token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func expectAccountPassword(t *testing.T, mock sqlmock.Sqlmock, userID, password string) {
+	t.Helper()
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT email, hashed_password FROM users WHERE id = \\$1").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "hashed_password"}).AddRow("ada@example.com", string(hashed)))
+}
+
+func TestDeleteAccount(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	uploadDir = t.TempDir()
+	app.Delete("/auth/account", withSession("user-1", "session-1"), deleteAccount)
+
+	// A stored upload of the user
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadDir, "user-1"), 0o700))
+	assert.NoError(t, os.WriteFile(uploadPath("user-1", "file-1"), []byte("scan"), 0o600))
+
+	expectAccountPassword(t, mock, "user-1", "correct horse")
+	mock.ExpectBegin()
+	for _, query := range accountDeletes {
+		mock.ExpectExec(regexp.QuoteMeta(query)).
+			WithArgs("user-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("DELETE", "/auth/account", strings.NewReader(`{"password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assertCookieCleared(t, resp)
+
+	_, err = os.Stat(filepath.Join(uploadDir, "user-1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeleteAccount_WrongPassword(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/account", withSession("user-1", "session-1"), deleteAccount)
+
+	// Nothing is deleted
+	expectAccountPassword(t, mock, "user-1", "correct horse")
+
+	req := httptest.NewRequest("DELETE", "/auth/account", strings.NewReader(`{"password":"wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteAccount_RollsBackOnFailure(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	uploadDir = t.TempDir()
+	app.Delete("/auth/account", withSession("user-1", "session-1"), deleteAccount)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadDir, "user-1"), 0o700))
+
+	expectAccountPassword(t, mock, "user-1", "correct horse")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(accountDeletes[0])).
+		WithArgs("user-1").
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("DELETE", "/auth/account", strings.NewReader(`{"password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Files stay with the rows
+	_, err = os.Stat(filepath.Join(uploadDir, "user-1"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+// AdminUser is an account as seen by administrators, with usage totals
+type AdminUser struct {
+	ID            string     `json:"id"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	EmailVerified bool       `json:"email_verified"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DisabledAt    *time.Time `json:"disabled_at"`
+	NoteCount     int        `json:"note_count"`
+	StorageBytes  int64      `json:"storage_bytes"`
+	SessionCount  int        `json:"session_count"`
+}
+
+// adminUserQuery selects users with their note, storage and session totals.
+// Storage is the size of the note text plus the original uploads.
+const adminUserQuery = `
+	SELECT
+		u.id, u.email, u.role, u.email_verified_at IS NOT NULL, u.created_at, u.disabled_at,
+		COALESCE(n.note_count, 0),
+		COALESCE(n.storage_bytes, 0) + (SELECT COALESCE(SUM(f.size_bytes), 0) FROM note_files f WHERE f.user_id = u.id),
+		(SELECT COUNT(*) FROM sessions s WHERE s.user_id = u.id AND s.rotated_at IS NULL AND s.expires_at > NOW())
+	FROM users u
+	LEFT JOIN (
+		SELECT user_id,
+			COUNT(*) AS note_count,
+			SUM(COALESCE(octet_length(content), 0) + COALESCE(octet_length(summary), 0)) AS storage_bytes
+		FROM notes
+		GROUP BY user_id
+	) n ON n.user_id = u.id
+`
+
+func scanAdminUser(row interface{ Scan(...interface{}) error }) (AdminUser, error) {
+	var user AdminUser
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Role,
+		&user.EmailVerified,
+		&user.CreatedAt,
+		&user.DisabledAt,
+		&user.NoteCount,
+		&user.StorageBytes,
+		&user.SessionCount,
+	)
+	return user, err
+}
+
+func adminListUsers(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultAdminPageSize)
+	if limit < 1 || limit > maxAdminPageSize {
+		limit = defaultAdminPageSize
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	// Optional case-insensitive email search
+	pattern := "%"
+	if q := normalizeEmail(c.Query("q")); q != "" {
+		replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+		pattern = "%" + replacer.Replace(q) + "%"
+	}
+
+	rows, err := db.Query(
+		adminUserQuery+" WHERE u.email LIKE $1 ORDER BY u.created_at DESC LIMIT $2 OFFSET $3",
+		pattern,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch users",
+		})
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		user, err := scanAdminUser(rows)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan user",
+			})
+		}
+		users = append(users, user)
+	}
+
+	return c.JSON(users)
+}
+
+func userNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "User not found",
+	})
+}
+
+func adminGetUser(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if !validNoteID(userID) {
+		return userNotFound(c)
+	}
+
+	user, err := scanAdminUser(db.QueryRow(adminUserQuery+" WHERE u.id = $1", userID))
+	if err == sql.ErrNoRows {
+		return userNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	return c.JSON(user)
+}
+
+// adminDisableUser blocks the account and ends its sessions. API keys stay
+// but are refused until the account is enabled again.
+func adminDisableUser(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if !validNoteID(userID) {
+		return userNotFound(c)
+	}
+	if userID == currentUserID(c) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot disable your own account",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE users SET disabled_at = COALESCE(disabled_at, NOW()) WHERE id = $1",
+		userID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable user",
+		})
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return userNotFound(c)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func adminEnableUser(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if !validNoteID(userID) {
+		return userNotFound(c)
+	}
+
+	result, err := db.Exec("UPDATE users SET disabled_at = NULL WHERE id = $1", userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable user",
+		})
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return userNotFound(c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// adminRevokeSessions force-expires every session of the user
+func adminRevokeSessions(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if !validNoteID(userID) {
+		return userNotFound(c)
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	if !exists {
+		return userNotFound(c)
+	}
+
+	_, err = db.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
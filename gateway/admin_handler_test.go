@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUserID      = "4b9e2d7a-6c1f-4a3e-8d5b-2f7c9e1a0b46"
+	testAdminID     = "9a1d5e3c-7b2f-4c8e-a6d0-3e5b7f9c1d24"
+	testOtherUserID = "1e6c8a4f-0d3b-4f7a-b2e9-5c1d7a3f8e60"
+)
+
+// withAdmin stands in for authMiddleware with an admin session
+func withAdmin(userID string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user_id", userID)
+		c.Locals("session_id", "session-admin")
+		c.Locals("role", roleAdmin)
+		return c.Next()
+	}
+}
+
+var adminUserColumns = []string{
+	"id", "email", "role", "email_verified", "created_at", "disabled_at",
+	"note_count", "storage_bytes", "session_count",
+}
+
+func TestRequireRole(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/admin/users", authMiddleware(), requireSession(), requireRole(roleAdmin), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	for _, tt := range []struct {
+		role   string
+		status int
+	}{
+		{roleAdmin, http.StatusOK},
+		{roleUser, http.StatusForbidden},
+	} {
+		token, err := generateToken("user-1")
+		assert.NoError(t, err)
+		mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+			WithArgs(hashToken(token), "user-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), tt.role))
+
+		req := httptest.NewRequest("GET", "/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.status, resp.StatusCode, tt.role)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminListUsers(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/admin/users", withAdmin("admin-1"), adminListUsers)
+
+	created := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM users u LEFT JOIN .* WHERE u.email LIKE \\$1 ORDER BY u.created_at DESC LIMIT \\$2 OFFSET \\$3").
+		WithArgs(`%ada\_l%`, 10, 20).
+		WillReturnRows(sqlmock.NewRows(adminUserColumns).
+			AddRow("user-1", "ada_lovelace@example.com", "user", true, created, nil, 12, int64(48213), 2))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/users?q=Ada_L&limit=10&offset=20", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var users []AdminUser
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&users))
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "ada_lovelace@example.com", users[0].Email)
+		assert.Equal(t, 12, users[0].NoteCount)
+		assert.Equal(t, int64(48213), users[0].StorageBytes)
+		assert.Equal(t, 2, users[0].SessionCount)
+		assert.Nil(t, users[0].DisabledAt)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminGetUser_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/admin/users/:id", withAdmin(testAdminID), adminGetUser)
+
+	mock.ExpectQuery("FROM users u LEFT JOIN .* WHERE u.id = \\$1").
+		WithArgs(testOtherUserID).
+		WillReturnError(sql.ErrNoRows)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/admin/users/"+testOtherUserID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminDisableUser(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/admin/users/:id/disable", withAdmin(testAdminID), adminDisableUser)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET disabled_at = COALESCE\\(disabled_at, NOW\\(\\)\\) WHERE id = \\$1").
+		WithArgs(testUserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$1").
+		WithArgs(testUserID).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/users/"+testUserID+"/disable", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminDisableUser_NotSelf(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/admin/users/:id/disable", withAdmin(testAdminID), adminDisableUser)
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/users/"+testAdminID+"/disable", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminEnableUser(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/admin/users/:id/enable", withAdmin(testAdminID), adminEnableUser)
+
+	mock.ExpectExec("UPDATE users SET disabled_at = NULL WHERE id = \\$1").
+		WithArgs(testUserID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET disabled_at = NULL WHERE id = \\$1").
+		WithArgs(testOtherUserID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/users/"+testUserID+"/enable", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("POST", "/admin/users/"+testOtherUserID+"/enable", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminRevokeSessions(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/admin/users/:id/sessions", withAdmin(testAdminID), adminRevokeSessions)
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM users WHERE id = \\$1\\)").
+		WithArgs(testUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$1").
+		WithArgs(testUserID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/admin/users/"+testUserID+"/sessions", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminRevokeSessions_UnknownUser(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/admin/users/:id/sessions", withAdmin(testAdminID), adminRevokeSessions)
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM users WHERE id = \\$1\\)").
+		WithArgs(testOtherUserID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/admin/users/"+testOtherUserID+"/sessions", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdminUserRoutes_MalformedID(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/admin/users/:id", withAdmin(testAdminID), adminGetUser)
+	app.Post("/admin/users/:id/disable", withAdmin(testAdminID), adminDisableUser)
+	app.Post("/admin/users/:id/enable", withAdmin(testAdminID), adminEnableUser)
+	app.Delete("/admin/users/:id/sessions", withAdmin(testAdminID), adminRevokeSessions)
+
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/admin/users/user-1"},
+		{"POST", "/admin/users/user-1/disable"},
+		{"POST", "/admin/users/user-1/enable"},
+		{"DELETE", "/admin/users/user-1/sessions"},
+	} {
+		resp, err := app.Test(httptest.NewRequest(tt.method, tt.path, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, tt.method+" "+tt.path)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+const (
+	// apiKeyPrefix tells API keys apart from JWTs in the Authorization header
+	apiKeyPrefix        = "nn_"
+	apiKeyDisplayLength = 11
+	maxAPIKeyNameLength = 100
+	maxAPIKeyExpiryDays = 365
+	// last_used_at is only written when it is older than this
+	apiKeyUsageResolution = time.Minute
+)
+
+// API key scopes. Sessions are not scoped; keys only reach routes whose
+// scope they were created with.
+const (
+	scopeNotesRead     = "notes:read"
+	scopeNotesWrite    = "notes:write"
+	scopeScheduleRead  = "schedule:read"
+	scopeScheduleWrite = "schedule:write"
+)
+
+var apiKeyScopes = []string{scopeNotesRead, scopeNotesWrite, scopeScheduleRead, scopeScheduleWrite}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// validateAPIKeyRequest normalises the request in place and reports
+// invalid fields
+func validateAPIKeyRequest(req *CreateAPIKeyRequest) FieldErrors {
+	req.Name = strings.TrimSpace(req.Name)
+
+	errs := FieldErrors{}
+	if req.Name == "" {
+		errs["name"] = "Name is required"
+	} else if len(req.Name) > maxAPIKeyNameLength {
+		errs["name"] = fmt.Sprintf("Name must be at most %d characters", maxAPIKeyNameLength)
+	}
+
+	if len(req.Scopes) == 0 {
+		errs["scopes"] = "At least one scope is required"
+	}
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !containsString(apiKeyScopes, scope) {
+			errs["scopes"] = fmt.Sprintf("Unknown scope %q", scope)
+			break
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	req.Scopes = scopes
+
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPIKeyExpiryDays {
+		errs["expires_in_days"] = fmt.Sprintf("Expiry must be between 1 and %d days", maxAPIKeyExpiryDays)
+	}
+	return errs
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func createAPIKey(c *fiber.Ctx) error {
+	var req CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if errs := validateAPIKeyRequest(&req); len(errs) > 0 {
+		return validationError(c, errs)
+	}
+
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate key",
+		})
+	}
+	key := apiKeyPrefix + secret
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		expiry := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	apiKey := APIKey{
+		Name:      req.Name,
+		Prefix:    key[:apiKeyDisplayLength],
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+	}
+	err = db.QueryRow(
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		currentUserID(c),
+		apiKey.Name,
+		apiKey.Prefix,
+		hashToken(key),
+		pq.Array(apiKey.Scopes),
+		expiresAt,
+	).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create key",
+		})
+	}
+
+	// The key itself is only ever shown in this response
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"api_key": apiKey,
+		"key":     key,
+	})
+}
+
+func listAPIKeys(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT id, name, prefix, scopes, created_at, last_used_at, expires_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch keys",
+		})
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(
+			&key.ID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Scopes),
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.ExpiresAt,
+		); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan key",
+			})
+		}
+		keys = append(keys, key)
+	}
+
+	return c.JSON(keys)
+}
+
+func apiKeyNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "API key not found",
+	})
+}
+
+func revokeAPIKey(c *fiber.Ctx) error {
+	keyID := c.Params("id")
+	if !validNoteID(keyID) {
+		return apiKeyNotFound(c)
+	}
+
+	result, err := db.Exec(
+		"DELETE FROM api_keys WHERE id = $1 AND user_id = $2",
+		keyID,
+		currentUserID(c),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke key",
+		})
+	}
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return apiKeyNotFound(c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// authenticateAPIKey is the API key branch of authMiddleware
+func authenticateAPIKey(c *fiber.Ctx, key string) error {
+	var apiKey struct {
+		ID        string
+		UserID    string
+		Scopes    []string
+		ExpiresAt sql.NullTime
+	}
+	err := db.QueryRow(`
+		SELECT k.id, k.user_id, k.scopes, k.expires_at
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = $1 AND u.disabled_at IS NULL
+	`, hashToken(key)).Scan(&apiKey.ID, &apiKey.UserID, pq.Array(&apiKey.Scopes), &apiKey.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid API key",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify API key",
+		})
+	}
+	if apiKey.ExpiresAt.Valid && time.Now().After(apiKey.ExpiresAt.Time) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key expired",
+		})
+	}
+
+	// Usage is informational, a failed update does not block the request
+	_, err = db.Exec(
+		"UPDATE api_keys SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2)",
+		apiKey.ID,
+		time.Now().Add(-apiKeyUsageResolution),
+	)
+	if err != nil {
+		log.Printf("[ERROR] Failed to record API key use: %v", err)
+	}
+
+	c.Locals("user_id", apiKey.UserID)
+	c.Locals("api_key_id", apiKey.ID)
+	c.Locals("scopes", apiKey.Scopes)
+	return c.Next()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAPIKey = "nn_0123456789abcdefghijklmnopqrstuvwxyzABCDEFG"
+
+func setupAPIKeyTestApp(t *testing.T) (*fiber.App, sqlmock.Sqlmock) {
+	app, mock := setupTestApp()
+	t.Cleanup(func() { db.Close() })
+
+	ok := func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"user_id": currentUserID(c)})
+	}
+	app.Get("/api/notes", authMiddleware(), requireScope(scopeNotesRead), ok)
+	app.Post("/api/notes", authMiddleware(), requireScope(scopeNotesWrite), ok)
+	app.Get("/auth/sessions", authMiddleware(), requireSession(), ok)
+	return app, mock
+}
+
+func expectAPIKey(mock sqlmock.Sqlmock, scopes string, expiresAt interface{}) {
+	mock.ExpectQuery("SELECT k.id, k.user_id, k.scopes, k.expires_at FROM api_keys k JOIN users u").
+		WithArgs(hashToken(testAPIKey)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "scopes", "expires_at"}).
+			AddRow("key-1", "user-1", scopes, expiresAt))
+}
+
+func apiKeyRequest(method, path string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	return req
+}
+
+func TestAuthMiddleware_APIKeyScopes(t *testing.T) {
+	app, mock := setupAPIKeyTestApp(t)
+
+	expectAPIKey(mock, "{notes:read}", nil)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = NOW\\(\\)").
+		WithArgs("key-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(apiKeyRequest("GET", "/api/notes"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "user-1", result["user_id"])
+
+	// Read-only keys cannot upload
+	expectAPIKey(mock, "{notes:read}", nil)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = NOW\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	resp, err = app.Test(apiKeyRequest("POST", "/api/notes"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "API key lacks scope notes:write", result["error"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_APIKeyCannotManageAccount(t *testing.T) {
+	app, mock := setupAPIKeyTestApp(t)
+
+	expectAPIKey(mock, "{notes:read,notes:write,schedule:read,schedule:write}", nil)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = NOW\\(\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(apiKeyRequest("GET", "/auth/sessions"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_APIKeyExpired(t *testing.T) {
+	app, mock := setupAPIKeyTestApp(t)
+
+	expectAPIKey(mock, "{notes:read}", time.Now().Add(-time.Hour))
+
+	resp, err := app.Test(apiKeyRequest("GET", "/api/notes"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_UnknownAPIKey(t *testing.T) {
+	app, mock := setupAPIKeyTestApp(t)
+
+	mock.ExpectQuery("SELECT k.id, k.user_id, k.scopes, k.expires_at FROM api_keys k JOIN users u").
+		WithArgs(hashToken(testAPIKey)).
+		WillReturnError(sql.ErrNoRows)
+
+	resp, err := app.Test(apiKeyRequest("GET", "/api/notes"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequireScope_SessionsAreUnscoped(t *testing.T) {
+	app, mock := setupAPIKeyTestApp(t)
+
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), "user"))
+
+	req := httptest.NewRequest("POST", "/api/notes", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/api-keys", withUser("user-1"), createAPIKey)
+
+	var storedHash, storedPrefix, storedScopes string
+	mock.ExpectQuery("INSERT INTO api_keys").
+		WithArgs("user-1", "nightly upload", captureArg{&storedPrefix}, captureArg{&storedHash}, captureArg{&storedScopes}, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow("key-1", time.Now()))
+
+	req := httptest.NewRequest("POST", "/auth/api-keys", strings.NewReader(
+		`{"name":" nightly upload ","scopes":["notes:write","notes:read","notes:write"]}`,
+	))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var result struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"api_key"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.True(t, strings.HasPrefix(result.Key, apiKeyPrefix))
+	assert.Equal(t, hashToken(result.Key), storedHash)
+	assert.Equal(t, result.Key[:apiKeyDisplayLength], storedPrefix)
+	assert.Equal(t, storedPrefix, result.APIKey.Prefix)
+	assert.Equal(t, "{\"notes:write\",\"notes:read\"}", storedScopes)
+	assert.Equal(t, []string{"notes:write", "notes:read"}, result.APIKey.Scopes)
+	assert.Nil(t, result.APIKey.ExpiresAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateAPIKey_Validation(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/api-keys", withUser("user-1"), createAPIKey)
+
+	req := httptest.NewRequest("POST", "/auth/api-keys", strings.NewReader(
+		`{"name":"","scopes":["admin:everything"],"expires_in_days":1000}`,
+	))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var result struct {
+		Fields map[string]string `json:"fields"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "Name is required", result.Fields["name"])
+	assert.Equal(t, `Unknown scope "admin:everything"`, result.Fields["scopes"])
+	assert.Contains(t, result.Fields["expires_in_days"], "365")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListAPIKeys(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/auth/api-keys", withUser("user-1"), listAPIKeys)
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT id, name, prefix, scopes, created_at, last_used_at, expires_at FROM api_keys").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "prefix", "scopes", "created_at", "last_used_at", "expires_at"}).
+			AddRow("key-1", "nightly upload", "nn_abcdefgh", []byte("{notes:write}"), now, now, nil))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/auth/api-keys", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var keys []map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&keys))
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, "nn_abcdefgh", keys[0]["prefix"])
+		assert.Equal(t, []interface{}{"notes:write"}, keys[0]["scopes"])
+		assert.NotNil(t, keys[0]["last_used_at"])
+		assert.Nil(t, keys[0]["expires_at"])
+		assert.NotContains(t, keys[0], "key_hash")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+const (
+	testKeyID      = "6d2f8b1e-4a7c-4e9d-b3f5-8c0a2e6d4b17"
+	testOtherKeyID = "2c7a9e5b-1f3d-4b8a-9e6c-4d0f8b2a6c93"
+)
+
+func TestRevokeAPIKey(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/api-keys/:id", withUser("user-1"), revokeAPIKey)
+
+	mock.ExpectExec("DELETE FROM api_keys WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testKeyID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM api_keys WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testOtherKeyID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/auth/api-keys/"+testKeyID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Someone else's key looks the same as a missing one
+	resp, err = app.Test(httptest.NewRequest("DELETE", "/auth/api-keys/"+testOtherKeyID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// A malformed id never reaches the database
+	resp, err = app.Test(httptest.NewRequest("DELETE", "/auth/api-keys/key-1", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
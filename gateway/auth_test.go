@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setupAuthTestApp(t *testing.T) (*fiber.App, sqlmock.Sqlmock) {
+	app, mock := setupTestApp()
+	t.Cleanup(func() { db.Close() })
+
+	app.Get("/api/whoami", authMiddleware(), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"user_id": currentUserID(c)})
+	})
+	return app, mock
+}
+
+func TestAuthMiddleware_MissingToken(t *testing.T) {
+	app, _ := setupAuthTestApp(t)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("X-User-ID", "spoofed-user")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAuthMiddleware_InvalidToken(t *testing.T) {
+	app, _ := setupAuthTestApp(t)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: "not-a-jwt"})
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAuthMiddleware_UserFromSession(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(token), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), "user"))
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: token})
+	req.Header.Set("X-User-ID", "spoofed-user")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "user-1", result["user_id"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_ExpiredSession(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(token), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(-time.Hour), "user"))
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: token})
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestSetupRoutes_ProtectsAPI(t *testing.T) {
+	app, _ := setupTestApp()
+	defer db.Close()
+	setupRoutes(app)
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/notes"},
+		{"POST", "/api/notes/upload"},
+		{"GET", "/api/study-blocks"},
+		{"GET", "/api/schedule"},
+		{"POST", "/api/schedule"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Set("X-User-ID", "spoofed-user")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, route.path)
+	}
+
+	// Auth endpoints are public
+	req := httptest.NewRequest("POST", "/auth/login", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAuthMiddleware_BearerToken(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(token), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), "user"))
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "user-1", result["user_id"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_BearerTakesPrecedence(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	headerToken, err := generateToken("user-1")
+	assert.NoError(t, err)
+	cookieToken, err := generateToken("user-2")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(headerToken), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), "user"))
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+headerToken)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: cookieToken})
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "user-1", result["user_id"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_InvalidBearerDoesNotFallBack(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	cookieToken, err := generateToken("user-2")
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: cookieToken})
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_MalformedAuthorizationHeader(t *testing.T) {
+	app, _ := setupAuthTestApp(t)
+
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+
+	for _, header := range []string{token, "Basic " + token, "Bearer ", "Bearer"} {
+		req := httptest.NewRequest("GET", "/api/whoami", nil)
+		req.Header.Set("Authorization", header)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+
+		var result map[string]string
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "Invalid authorization header", result["error"])
+	}
+}
+
+func TestLogin_RecordsDeviceHint(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/login", login)
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "totp_enabled", "disabled"}).AddRow("user-1", string(hashed), false, false))
+	mock.ExpectExec("INSERT INTO sessions").
+		WithArgs("user-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "neuronote-cli/1.0").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"ada@example.com","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "neuronote-cli/1.0")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.NotEmpty(t, result["token"])
+	assert.NotEmpty(t, result["refresh_token"])
+	assert.Equal(t, refreshCookiePath, findCookie(resp, refreshCookieName).Path)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_RejectsNonAccessTokens(t *testing.T) {
+	app, _ := setupAuthTestApp(t)
+
+	// A legacy 30-day token carries no token type
+	claims := Claims{
+		UserID: "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := signingKeys.sign(claims)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAuthMiddleware_RejectsRefreshToken(t *testing.T) {
+	app, _ := setupAuthTestApp(t)
+
+	refreshToken, err := generateOpaqueToken()
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// captureArg is a sqlmock argument matcher that records the string bound
+// to a query parameter
+type captureArg struct {
+	value *string
+}
+
+func (a captureArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*a.value = s
+	return ok
+}
+
+func TestLogin_StoresTokenDigests(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/login", login)
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "totp_enabled", "disabled"}).AddRow("user-1", string(hashed), false, false))
+
+	var storedToken, storedRefresh string
+	mock.ExpectExec("INSERT INTO sessions \\(user_id, token_hash, refresh_token_hash").
+		WithArgs("user-1", captureArg{&storedToken}, captureArg{&storedRefresh}, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"ada@example.com","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	token, _ := result["token"].(string)
+	refreshToken, _ := result["refresh_token"].(string)
+	assert.Equal(t, hashToken(token), storedToken)
+	assert.Equal(t, hashToken(refreshToken), storedRefresh)
+	assert.NotContains(t, storedToken, token)
+	assert.Len(t, storedToken, 64)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthMiddleware_RawTokenDoesNotMatchDigest(t *testing.T) {
+	app, mock := setupAuthTestApp(t)
+
+	// A row still holding the raw token, as before the digest migration
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(token), "user-1").
+		WillReturnError(sql.ErrNoRows)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSignup_ValidationErrors(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/signup", signup)
+
+	req := httptest.NewRequest("POST", "/auth/signup", strings.NewReader(`{"email":"not-an-email","password":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var result struct {
+		Error  string            `json:"error"`
+		Fields map[string]string `json:"fields"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "Validation failed", result.Error)
+	assert.Equal(t, "Email is not a valid address", result.Fields["email"])
+	assert.Equal(t, "Password must be at least 8 characters", result.Fields["password"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSignup_NormalisesEmail(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/signup", signup)
+
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("ada@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	expectIssueUserToken(mock, "user-1", emailVerificationPurpose, nil)
+	mock.ExpectExec("INSERT INTO sessions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/auth/signup", strings.NewReader(`{"email":"  Ada@Example.com ","password":"purple staple lecture"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSignup_DuplicateEmail(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/signup", signup)
+
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs("ada@example.com", sqlmock.AnyArg()).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+
+	req := httptest.NewRequest("POST", "/auth/signup", strings.NewReader(`{"email":"ada@example.com","password":"purple staple lecture"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSignup_OtherDatabaseError(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/signup", signup)
+
+	mock.ExpectQuery("INSERT INTO users").
+		WillReturnError(&pq.Error{Code: "23502", Message: "duplicate key value"})
+
+	req := httptest.NewRequest("POST", "/auth/signup", strings.NewReader(`{"email":"ada@example.com","password":"purple staple lecture"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestLogin_NormalisesEmail(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/login", login)
+
+	mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+		WithArgs("ada@example.com").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO login_audit").
+		WithArgs("ada@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "unknown_email").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":" ADA@example.com","password":"whatever"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLogin_DisabledAccount(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/login", login)
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "totp_enabled", "disabled"}).AddRow("user-1", string(hashed), false, true))
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"ada@example.com","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Nil(t, findCookie(resp, cookieName))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
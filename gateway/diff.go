@@ -0,0 +1,108 @@
+package main
+
+import "strings"
+
+// maxDiffEdits bounds the work and memory of a diff. Texts further apart
+// than this are shown as the old lines removed and the new ones added.
+const maxDiffEdits = 1000
+
+// DiffLine is one line of a line-level diff
+type DiffLine struct {
+	Op   string `json:"op"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines returns the shortest edit script from oldText to newText, line
+// by line, using Myers' algorithm
+func diffLines(oldText, newText string) []DiffLine {
+	a, b := splitLines(oldText), splitLines(newText)
+	n, m := len(a), len(b)
+
+	// v[k] is the furthest x reached on diagonal k = x - y. trace keeps
+	// v for diagonals -d..d as it was before each step d, for backtracking.
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= n+m && d <= maxDiffEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(trace, a, b)
+			}
+		}
+	}
+	return replaceLines(a, b)
+}
+
+func backtrackDiff(trace [][]int, a, b []string) []DiffLine {
+	var lines []DiffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			lines = append(lines, DiffLine{Op: "equal", Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				lines = append(lines, DiffLine{Op: "insert", Text: b[y-1]})
+			} else {
+				lines = append(lines, DiffLine{Op: "delete", Text: a[x-1]})
+			}
+			x, y = prevX, prevY
+		}
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	if lines == nil {
+		lines = []DiffLine{}
+	}
+	return lines
+}
+
+func replaceLines(a, b []string) []DiffLine {
+	lines := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a {
+		lines = append(lines, DiffLine{Op: "delete", Text: line})
+	}
+	for _, line := range b {
+		lines = append(lines, DiffLine{Op: "insert", Text: line})
+	}
+	return lines
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// applyDiff rebuilds both sides of a diff
+func applyDiff(lines []DiffLine) (string, string) {
+	var before, after []string
+	for _, line := range lines {
+		if line.Op != "insert" {
+			before = append(before, line.Text)
+		}
+		if line.Op != "delete" {
+			after = append(after, line.Text)
+		}
+	}
+	return strings.Join(before, "\n"), strings.Join(after, "\n")
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := diffLines("cells\nhave\nmitochondria\nand ribosomes", "cells\nmostly have\nmitochondria\nand ribosomes\nand a nucleus")
+	assert.Equal(t, []DiffLine{
+		{Op: "equal", Text: "cells"},
+		{Op: "delete", Text: "have"},
+		{Op: "insert", Text: "mostly have"},
+		{Op: "equal", Text: "mitochondria"},
+		{Op: "equal", Text: "and ribosomes"},
+		{Op: "insert", Text: "and a nucleus"},
+	}, lines)
+}
+
+func TestDiffLines_EdgeCases(t *testing.T) {
+	assert.Equal(t, []DiffLine{}, diffLines("", ""))
+	assert.Equal(t, []DiffLine{{Op: "insert", Text: "new"}}, diffLines("", "new"))
+	assert.Equal(t, []DiffLine{{Op: "delete", Text: "old"}}, diffLines("old", ""))
+	assert.Equal(t, []DiffLine{{Op: "equal", Text: "same"}}, diffLines("same", "same"))
+}
+
+func TestDiffLines_RoundTrips(t *testing.T) {
+	pairs := [][2]string{
+		{"a\nb\nc\na\nb\nb\na", "c\nb\na\nb\na\nc"},
+		{"x\ny\nz", "z\ny\nx"},
+		{"one\ntwo\nthree\nfour", "zero\none\nthree\nfive"},
+	}
+	for _, pair := range pairs {
+		lines := diffLines(pair[0], pair[1])
+		before, after := applyDiff(lines)
+		assert.Equal(t, pair[0], before)
+		assert.Equal(t, pair[1], after)
+	}
+
+	// The Myers paper example needs five edits
+	edits := 0
+	for _, line := range diffLines("a\nb\nc\na\nb\nb\na", "c\nb\na\nb\na\nc") {
+		if line.Op != "equal" {
+			edits++
+		}
+	}
+	assert.Equal(t, 5, edits)
+}
+
+func TestDiffLines_TooManyEdits(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= maxDiffEdits; i++ {
+		a = append(a, "old")
+		b = append(b, "new")
+	}
+	lines := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+	assert.Len(t, lines, 2*len(a))
+	assert.Equal(t, "delete", lines[0].Op)
+	assert.Equal(t, "insert", lines[len(lines)-1].Op)
+}
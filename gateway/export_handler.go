@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AccountExport is everything a user can download about themselves
+type AccountExport struct {
+	Account     ExportedAccount `json:"account"`
+	Notebooks   []Notebook      `json:"notebooks"`
+	Notes       []ExportedNote  `json:"notes"`
+	StudyBlocks []StudyBlock    `json:"study_blocks"`
+	Files       []NoteFile      `json:"files"`
+}
+
+type ExportedAccount struct {
+	ID               string     `json:"id"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExportedAt       time.Time  `json:"exported_at"`
+}
+
+// ExportedNote is a note with everything generated from it
+type ExportedNote struct {
+	ID         string          `json:"id"`
+	Title      string          `json:"title"`
+	Content    string          `json:"content"`
+	Summary    string          `json:"summary"`
+	NotebookID *string         `json:"notebook_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	QuizCards  json.RawMessage `json:"quiz_cards"`
+	OCRBlocks  json.RawMessage `json:"ocr_blocks"`
+	AudioNotes json.RawMessage `json:"audio_notes"`
+	Tags       json.RawMessage `json:"tags"`
+	Revisions  json.RawMessage `json:"revisions"`
+}
+
+const exportNotesQuery = `
+	SELECT n.id, COALESCE(n.title, ''), COALESCE(n.content, ''), COALESCE(n.summary, ''), n.notebook_id, n.created_at, n.updated_at,
+		COALESCE((SELECT json_agg(json_build_object('id', q.id, 'question', q.question, 'answer', q.answer))
+			FROM quiz_cards q WHERE q.note_id = n.id), '[]'),
+		COALESCE((SELECT json_agg(json_build_object('id', o.id, 'text', o.text, 'bbox', o.bbox))
+			FROM ocr_blocks o WHERE o.note_id = n.id), '[]'),
+		COALESCE((SELECT json_agg(json_build_object('id', a.id, 'transcript', a.transcript))
+			FROM audio_notes a WHERE a.note_id = n.id), '[]'),
+		COALESCE((SELECT json_agg(t.tag) FROM tags t WHERE t.note_id = n.id), '[]'),
+		COALESCE((SELECT json_agg(json_build_object('revision', r.revision, 'title', r.title, 'content', r.content,
+			'summary', r.summary, 'created_at', r.created_at) ORDER BY r.revision)
+			FROM note_revisions r WHERE r.note_id = n.id), '[]')
+	FROM notes n
+	WHERE n.user_id = $1
+	ORDER BY n.created_at ASC
+`
+
+// exportData streams a zip with the user's data as JSON and the original
+// uploads under uploads/<file id>/<filename>. The rows are read before the
+// first byte is sent so database errors still get a proper status.
+func exportData(c *fiber.Ctx) error {
+	export, err := loadAccountExport(currentUserID(c))
+	if err != nil {
+		log.Printf("[ERROR] Failed to load export: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to export data",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="neuronote-export.zip"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := writeExportArchive(w, export); err != nil {
+			log.Printf("[ERROR] Failed to write export for %s: %v", export.Account.ID, err)
+		}
+	})
+	return nil
+}
+
+func loadAccountExport(userID string) (*AccountExport, error) {
+	export := &AccountExport{
+		Notebooks:   []Notebook{},
+		Notes:       []ExportedNote{},
+		StudyBlocks: []StudyBlock{},
+		Files:       []NoteFile{},
+	}
+
+	account := &export.Account
+	var verifiedAt sql.NullTime
+	err := db.QueryRow(
+		"SELECT id, email, role, email_verified_at, totp_enabled_at IS NOT NULL, created_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&account.ID, &account.Email, &account.Role, &verifiedAt, &account.TwoFactorEnabled, &account.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		account.EmailVerifiedAt = &verifiedAt.Time
+	}
+	account.ExportedAt = time.Now().UTC()
+
+	notebookRows, err := db.Query(notebookSelect+" WHERE b.user_id = $1 ORDER BY b.created_at ASC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer notebookRows.Close()
+	for notebookRows.Next() {
+		notebook, err := scanNotebook(notebookRows)
+		if err != nil {
+			return nil, err
+		}
+		export.Notebooks = append(export.Notebooks, notebook)
+	}
+	if err := notebookRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(exportNotesQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var note ExportedNote
+		var notebookID sql.NullString
+		var quizCards, ocrBlocks, audioNotes, tags, revisions []byte
+		err := rows.Scan(
+			&note.ID, &note.Title, &note.Content, &note.Summary, &notebookID, &note.CreatedAt, &note.UpdatedAt,
+			&quizCards, &ocrBlocks, &audioNotes, &tags, &revisions,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if notebookID.Valid {
+			note.NotebookID = &notebookID.String
+		}
+		note.QuizCards = json.RawMessage(quizCards)
+		note.OCRBlocks = json.RawMessage(ocrBlocks)
+		note.AudioNotes = json.RawMessage(audioNotes)
+		note.Tags = json.RawMessage(tags)
+		note.Revisions = json.RawMessage(revisions)
+		export.Notes = append(export.Notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	blockRows, err := db.Query(`
+		SELECT id, start_time, end_time, note_id, status
+		FROM study_blocks
+		WHERE user_id = $1
+		ORDER BY start_time ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer blockRows.Close()
+	for blockRows.Next() {
+		var block StudyBlock
+		if err := blockRows.Scan(&block.ID, &block.StartTime, &block.EndTime, &block.NoteID, &block.Status); err != nil {
+			return nil, err
+		}
+		export.StudyBlocks = append(export.StudyBlocks, block)
+	}
+	if err := blockRows.Err(); err != nil {
+		return nil, err
+	}
+
+	fileRows, err := db.Query(`
+		SELECT id, note_id, filename, content_type, size_bytes, created_at
+		FROM note_files
+		WHERE user_id = $1
+		ORDER BY created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer fileRows.Close()
+	for fileRows.Next() {
+		var file NoteFile
+		if err := fileRows.Scan(&file.ID, &file.NoteID, &file.Filename, &file.ContentType, &file.SizeBytes, &file.CreatedAt); err != nil {
+			return nil, err
+		}
+		export.Files = append(export.Files, file)
+	}
+	return export, fileRows.Err()
+}
+
+// writeExportArchive writes the export as a zip. Files missing from disk
+// are listed in files.json but left out of the archive.
+func writeExportArchive(w io.Writer, export *AccountExport) error {
+	archive := zip.NewWriter(w)
+
+	documents := []struct {
+		name  string
+		value interface{}
+	}{
+		{"account.json", export.Account},
+		{"notebooks.json", export.Notebooks},
+		{"notes.json", export.Notes},
+		{"study_blocks.json", export.StudyBlocks},
+		{"files.json", export.Files},
+	}
+	for _, doc := range documents {
+		entry, err := archive.Create(doc.name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(doc.value); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range export.Files {
+		if err := addExportFile(archive, export.Account.ID, file); err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("[WARN] Upload %s of %s is missing from disk", file.ID, export.Account.ID)
+				continue
+			}
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func addExportFile(archive *zip.Writer, userID string, file NoteFile) error {
+	src, err := os.Open(uploadPath(userID, file.ID))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     "uploads/" + file.ID + "/" + filepath.Base(file.Filename),
+		Method:   zip.Deflate,
+		Modified: file.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, src)
+	return err
+}
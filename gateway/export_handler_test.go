@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func readZipEntry(t *testing.T, archive *zip.Reader, name string) []byte {
+	t.Helper()
+	for _, file := range archive.File {
+		if file.Name == name {
+			rc, err := file.Open()
+			assert.NoError(t, err)
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			assert.NoError(t, err)
+			return data
+		}
+	}
+	t.Fatalf("%s not in archive", name)
+	return nil
+}
+
+func TestExportData(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	uploadDir = t.TempDir()
+	app.Get("/api/export", withSession("user-1", "session-1"), exportData)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadDir, "user-1"), 0o700))
+	assert.NoError(t, os.WriteFile(uploadPath("user-1", "file-1"), []byte("lecture scan"), 0o600))
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT id, email, role, email_verified_at").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "email_verified_at", "two_factor", "created_at"}).
+			AddRow("user-1", "ada@example.com", roleUser, now, false, now))
+	mock.ExpectQuery("FROM notebooks b WHERE b.user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(notebookColumns).AddRow(testNotebookID, "Biology", now, 1, now, now))
+	mock.ExpectQuery("FROM notes n WHERE n.user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "content", "summary", "notebook_id", "created_at", "updated_at", "quiz_cards", "ocr_blocks", "audio_notes", "tags", "revisions"}).
+			AddRow("note-1", "Cells", "Mitochondria", "Energy", testNotebookID, now, now, `[{"id":"card-1","question":"Q","answer":"A"}]`, "[]", "[]", `["biology"]`, `[{"revision":1,"title":"Cells"}]`))
+	mock.ExpectQuery("FROM study_blocks WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "start_time", "end_time", "note_id", "status"}).
+			AddRow("block-1", now, now.Add(time.Hour), "note-1", "scheduled"))
+	mock.ExpectQuery("FROM note_files WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "note_id", "filename", "content_type", "size_bytes", "created_at"}).
+			AddRow("file-1", "note-1", "scan.png", "image/png", 12, now).
+			AddRow("file-2", "note-1", "lost.png", "image/png", 3, now))
+
+	req := httptest.NewRequest("GET", "/api/export", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var account ExportedAccount
+	assert.NoError(t, json.Unmarshal(readZipEntry(t, archive, "account.json"), &account))
+	assert.Equal(t, "ada@example.com", account.Email)
+
+	var notes []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(readZipEntry(t, archive, "notes.json"), &notes))
+	if assert.Len(t, notes, 1) {
+		assert.Equal(t, []interface{}{"biology"}, notes[0]["tags"])
+		assert.Len(t, notes[0]["quiz_cards"], 1)
+		assert.Equal(t, testNotebookID, notes[0]["notebook_id"])
+		assert.Len(t, notes[0]["revisions"], 1)
+	}
+
+	var notebooks []Notebook
+	assert.NoError(t, json.Unmarshal(readZipEntry(t, archive, "notebooks.json"), &notebooks))
+	assert.Len(t, notebooks, 1)
+
+	// Stored originals are included, missing ones only listed
+	assert.Equal(t, "lecture scan", string(readZipEntry(t, archive, "uploads/file-1/scan.png")))
+	var files []NoteFile
+	assert.NoError(t, json.Unmarshal(readZipEntry(t, archive, "files.json"), &files))
+	assert.Len(t, files, 2)
+	assert.Len(t, archive.File, 6)
+}
+
+func TestExportData_DatabaseError(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/export", withSession("user-1", "session-1"), exportData)
+
+	mock.ExpectQuery("SELECT id, email, role, email_verified_at").
+		WithArgs("user-1").
+		WillReturnError(os.ErrDeadlineExceeded)
+
+	req := httptest.NewRequest("GET", "/api/export", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
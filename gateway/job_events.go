@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Events of a job's stream, besides stage and retrying which are written
+// along with the job's own changes. A job ends with note or failed.
+const (
+	jobEventTranscript = "transcript"
+	jobEventText       = "text"
+	jobEventSummary    = "summary"
+	jobEventFailed     = "failed"
+	jobEventNote       = "note"
+)
+
+const (
+	// Events written by workers on other instances are found by polling
+	jobEventPollInterval = 2 * time.Second
+	// A comment is sent on a quiet stream so proxies keep it open and a
+	// client that went away is noticed
+	jobEventKeepAlive = 15 * time.Second
+	// How long an EventSource waits before reconnecting, in milliseconds
+	jobEventRetry = 3000
+)
+
+// jobEvent is one event of a job's stream; Data is JSON
+type jobEvent struct {
+	ID    int64
+	Event string
+	Data  string
+}
+
+// execer is a database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// jobEventHub wakes the streams of this instance when their job has news
+type jobEventHub struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+var jobEvents = &jobEventHub{waiters: map[string]map[chan struct{}]bool{}}
+
+func (h *jobEventHub) subscribe(jobID string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if h.waiters[jobID] == nil {
+		h.waiters[jobID] = map[chan struct{}]bool{}
+	}
+	h.waiters[jobID][ch] = true
+	return ch
+}
+
+func (h *jobEventHub) unsubscribe(jobID string, ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.waiters[jobID], ch)
+	if len(h.waiters[jobID]) == 0 {
+		delete(h.waiters, jobID)
+	}
+}
+
+func (h *jobEventHub) publish(jobID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.waiters[jobID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// recordJobEvent appends an event to the job's stream
+func recordJobEvent(exec execer, jobID, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec("INSERT INTO job_events (job_id, event, data) VALUES ($1, $2, $3)", jobID, event, payload)
+	return err
+}
+
+func loadJobEvents(jobID string, after int64) ([]jobEvent, error) {
+	rows, err := db.Query("SELECT id, event, data FROM job_events WHERE job_id = $1 AND id > $2 ORDER BY id", jobID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []jobEvent{}
+	for rows.Next() {
+		var event jobEvent
+		if err := rows.Scan(&event.ID, &event.Event, &event.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// lastEventID is where a reconnecting client left off. EventSource sends
+// it as a header; last_event_id in the query serves clients that cannot.
+func lastEventID(c *fiber.Ctx) (int64, bool) {
+	value := c.Get("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return 0, true
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	return id, err == nil && id >= 0
+}
+
+// streamJobEvents sends a job's progress as server-sent events: stage
+// changes, the transcript or extracted text and the summary as each stage
+// finishes, then the note or the failure, after which the stream ends.
+// Events already sent are skipped on reconnect.
+func streamJobEvents(c *fiber.Ctx) error {
+	jobID := c.Params("id")
+	if !validNoteID(jobID) {
+		return jobNotFound(c)
+	}
+	after, ok := lastEventID(c)
+	if !ok {
+		return validationError(c, FieldErrors{"last_event_id": "Last-Event-ID must be an event id"})
+	}
+
+	var owned bool
+	err := db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM jobs WHERE id = $1 AND user_id = $2)",
+		jobID,
+		currentUserID(c),
+	).Scan(&owned)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get job",
+		})
+	}
+	if !owned {
+		return jobNotFound(c)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		writeJobEvents(w, jobID, after)
+	})
+	return nil
+}
+
+// writeJobEvents runs a job's stream until the job ends or the client
+// goes away
+func writeJobEvents(w *bufio.Writer, jobID string, after int64) {
+	wake := jobEvents.subscribe(jobID)
+	defer jobEvents.unsubscribe(jobID, wake)
+	poll := time.NewTicker(jobEventPollInterval)
+	defer poll.Stop()
+
+	fmt.Fprintf(w, "retry: %d\n\n", jobEventRetry)
+	if err := w.Flush(); err != nil {
+		return
+	}
+	lastWrite := time.Now()
+	for {
+		events, err := loadJobEvents(jobID, after)
+		if err != nil {
+			// The client reconnects and resumes after the last event
+			return
+		}
+		for _, event := range events {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, event.Data)
+			after = event.ID
+			if event.Event == jobEventNote || event.Event == jobEventFailed {
+				w.Flush()
+				return
+			}
+		}
+		if len(events) > 0 || time.Since(lastWrite) >= jobEventKeepAlive {
+			if len(events) == 0 {
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-wake:
+		case <-poll.C:
+		}
+	}
+}
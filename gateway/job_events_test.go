@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func expectJobOwned(mock sqlmock.Sqlmock, userID string, owned bool) {
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM jobs WHERE id = \\$1 AND user_id = \\$2\\)").
+		WithArgs(testJobID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(owned))
+}
+
+func TestStreamJobEvents(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/jobs/:id/events", withUser("user-1"), streamJobEvents)
+
+	expectJobOwned(mock, "user-1", true)
+	mock.ExpectQuery("FROM job_events WHERE job_id = \\$1 AND id > \\$2").
+		WithArgs(testJobID, int64(0)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event", "data"}).
+			AddRow(1, "stage", `{"stage":"ocr"}`).
+			AddRow(2, jobEventText, `{"text":"Mitochondria"}`).
+			AddRow(3, jobEventNote, `{"id":"`+testNoteID+`"}`))
+
+	req := httptest.NewRequest("GET", "/api/jobs/"+testJobID+"/events", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "retry: 3000\n\n"+
+		"id: 1\nevent: stage\ndata: {\"stage\":\"ocr\"}\n\n"+
+		"id: 2\nevent: text\ndata: {\"text\":\"Mitochondria\"}\n\n"+
+		"id: 3\nevent: note\ndata: {\"id\":\""+testNoteID+"\"}\n\n", string(body))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamJobEvents_Resume(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/jobs/:id/events", withUser("user-1"), streamJobEvents)
+
+	// Only what came after the client's last event is sent again
+	expectJobOwned(mock, "user-1", true)
+	mock.ExpectQuery("FROM job_events WHERE job_id = \\$1 AND id > \\$2").
+		WithArgs(testJobID, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event", "data"}).
+			AddRow(8, jobEventFailed, `{"error":"unsupported file type"}`))
+
+	req := httptest.NewRequest("GET", "/api/jobs/"+testJobID+"/events", nil)
+	req.Header.Set("Last-Event-ID", "7")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "id: 8\nevent: failed\n")
+	assert.NotContains(t, string(body), "id: 7\n")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamJobEvents_Rejected(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/jobs/:id/events", withUser("user-1"), streamJobEvents)
+
+	req := httptest.NewRequest("GET", "/api/jobs/"+testJobID+"/events?last_event_id=abc", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Another user's job looks the same as a missing one
+	expectJobOwned(mock, "user-1", false)
+	req = httptest.NewRequest("GET", "/api/jobs/"+testJobID+"/events", nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestJobEventHub(t *testing.T) {
+	hub := &jobEventHub{waiters: map[string]map[chan struct{}]bool{}}
+	wake := hub.subscribe(testJobID)
+
+	// Several events before the stream looks coalesce into one wake-up
+	hub.publish(testJobID)
+	hub.publish(testJobID)
+	assert.Len(t, wake, 1)
+	<-wake
+
+	hub.unsubscribe(testJobID, wake)
+	hub.publish(testJobID)
+	assert.Len(t, wake, 0)
+	assert.Empty(t, hub.waiters)
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+const (
+	stageOCR       = "ocr"
+	stageASR       = "asr"
+	stageSummarise = "summarise"
+	stageQA        = "qa"
+
+	defaultJobWorkers = 2
+	maxJobAttempts    = 3
+	jobPollInterval   = 2 * time.Second
+	// A running job whose stage has not moved for this long is assumed
+	// lost with its worker. Each ML call is bounded by the client timeout.
+	jobLease = 15 * time.Minute
+
+	// Quiz cards and tags generated per note
+	maxQuizQuestions  = 5
+	maxNoteKeyphrases = 5
+
+	// A text upload becomes the note content and is sent whole to the ML
+	// service, so it is held in memory. Larger ones fail their job.
+	maxTextUploadBytes = 10 << 20
+)
+
+// errUnprocessable fails a job without retrying, the upload itself is the
+// problem
+var errUnprocessable = errors.New("upload cannot be processed")
+
+// errJobLeaseLost stops a run whose job was taken over by another worker
+// once its lease ran out. The run leaves the job and its upload alone.
+var errJobLeaseLost = errors.New("job lease lost")
+
+// mlClient runs the ML stages of upload jobs
+var mlClient MLClient
+
+// jobWake nudges an idle worker when a job is queued by this instance;
+// jobs from other instances are picked up on the next poll
+var jobWake = make(chan struct{}, 1)
+
+// Job is an upload being turned into a note
+type Job struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Stage       string     `json:"stage,omitempty"`
+	NoteID      string     `json:"note_id,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"content_type"`
+	SizeBytes   int64      `json:"size_bytes"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+// claimedJob is what a worker needs to process a job
+type claimedJob struct {
+	ID          string
+	UserID      string
+	NotebookID  sql.NullString
+	Filename    string
+	ContentType string
+	SizeBytes   int64
+	Attempts    int
+}
+
+const jobSelect = `
+	SELECT id, status, COALESCE(stage, ''), COALESCE(note_id::text, ''), COALESCE(error, ''),
+		filename, content_type, size_bytes, created_at, started_at, finished_at
+	FROM jobs
+`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (Job, error) {
+	var job Job
+	var startedAt, finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Status, &job.Stage, &job.NoteID, &job.Error,
+		&job.Filename, &job.ContentType, &job.SizeBytes, &job.CreatedAt, &startedAt, &finishedAt)
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, err
+}
+
+// loadJobWorkers reads JOB_WORKERS, the number of jobs this instance runs
+// at once
+func loadJobWorkers() (int, error) {
+	value := os.Getenv("JOB_WORKERS")
+	if value == "" {
+		return defaultJobWorkers, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid JOB_WORKERS %q", value)
+	}
+	return n, nil
+}
+
+// rowQuerier is a database or a transaction
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// enqueueJob records an upload already staged under its job id. Call
+// wakeJobWorker once the job is committed.
+func enqueueJob(q rowQuerier, jobID, userID, notebookID, filename, contentType string, size int64) (Job, error) {
+	var notebook interface{}
+	if notebookID != "" {
+		notebook = notebookID
+	}
+	return scanJob(q.QueryRow(`
+		INSERT INTO jobs (id, user_id, notebook_id, filename, content_type, size_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, '', '', '', filename, content_type, size_bytes, created_at, started_at, finished_at
+	`, jobID, userID, notebook, filename, contentType, size))
+}
+
+// wakeJobWorker has an idle worker of this instance look for a new job
+func wakeJobWorker() {
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+}
+
+func getJob(c *fiber.Ctx) error {
+	jobID := c.Params("id")
+	if !validNoteID(jobID) {
+		return jobNotFound(c)
+	}
+
+	job, err := scanJob(db.QueryRow(jobSelect+" WHERE id = $1 AND user_id = $2", jobID, currentUserID(c)))
+	if err == sql.ErrNoRows {
+		return jobNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get job",
+		})
+	}
+	return c.JSON(job)
+}
+
+func jobNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Job not found",
+	})
+}
+
+// startJobWorkers runs n workers until ctx is done
+func startJobWorkers(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		go runJobWorker(ctx)
+	}
+}
+
+func runJobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			job, err := claimJob()
+			if err != nil {
+				log.Printf("[ERROR] Failed to claim job: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			processJob(job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-jobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimJob takes the oldest queued job, or one whose worker went away, and
+// marks it running. It returns nil when there is nothing to do.
+func claimJob() (*claimedJob, error) {
+	var job claimedJob
+	err := db.QueryRow(`
+		UPDATE jobs SET status = 'running', stage = NULL, attempts = attempts + 1,
+			started_at = NOW(), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = 'queued' OR (status = 'running' AND updated_at < NOW() - make_interval(secs => $1))
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, user_id, notebook_id, filename, content_type, size_bytes, attempts
+	`, jobLease.Seconds()).Scan(&job.ID, &job.UserID, &job.NotebookID, &job.Filename, &job.ContentType, &job.SizeBytes, &job.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// processJob runs a claimed job to the end. Failures of the ML service are
+// retried up to maxJobAttempts; uploads it cannot read fail at once.
+func processJob(job *claimedJob) {
+	err := runJob(job)
+	if err == nil {
+		jobEvents.publish(job.ID)
+		return
+	}
+	if errors.Is(err, errJobLeaseLost) {
+		log.Printf("[WARN] Job %s was taken over after attempt %d overran its lease", job.ID, job.Attempts)
+		return
+	}
+	log.Printf("[ERROR] Job %s failed on attempt %d: %v", job.ID, job.Attempts, err)
+
+	if !errors.Is(err, errUnprocessable) && job.Attempts < maxJobAttempts {
+		err := leaseHeld(db.Exec(`
+			WITH job AS (
+				UPDATE jobs SET status = 'queued', updated_at = NOW()
+				WHERE id = $1 AND status = 'running' AND attempts = $2 RETURNING id, attempts
+			)
+			INSERT INTO job_events (job_id, event, data)
+			SELECT id, 'retrying', jsonb_build_object('attempt', attempts) FROM job
+		`, job.ID, job.Attempts))
+		jobEvents.publish(job.ID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to requeue job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	dbErr := leaseHeld(db.Exec(`
+		WITH job AS (
+			UPDATE jobs SET status = 'failed', error = $3, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $1 AND status = 'running' AND attempts = $2 RETURNING id
+		)
+		INSERT INTO job_events (job_id, event, data)
+		SELECT id, 'failed', jsonb_build_object('error', $3::text) FROM job
+	`, job.ID, job.Attempts, err.Error()))
+	jobEvents.publish(job.ID)
+	if errors.Is(dbErr, errJobLeaseLost) {
+		// The upload now belongs to the run that took the job over
+		log.Printf("[WARN] Job %s was taken over after attempt %d overran its lease", job.ID, job.Attempts)
+		return
+	}
+	if dbErr != nil {
+		log.Printf("[ERROR] Failed to mark job %s failed: %v", job.ID, dbErr)
+	}
+	if err := removeUpload(job.UserID, job.ID); err != nil {
+		log.Printf("[ERROR] Failed to remove upload of job %s: %v", job.ID, err)
+	}
+}
+
+// leaseHeld checks a job UPDATE fenced on the run's attempt. No row
+// means another worker has claimed the job since.
+func leaseHeld(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errJobLeaseLost
+	}
+	return nil
+}
+
+// setJobStage records progress, which also renews the job's lease
+func setJobStage(job *claimedJob, stage string) error {
+	err := leaseHeld(db.Exec(`
+		WITH job AS (
+			UPDATE jobs SET stage = $2, updated_at = NOW()
+			WHERE id = $1 AND status = 'running' AND attempts = $3 RETURNING id
+		)
+		INSERT INTO job_events (job_id, event, data)
+		SELECT id, 'stage', jsonb_build_object('stage', $2::text) FROM job
+	`, job.ID, stage, job.Attempts))
+	jobEvents.publish(job.ID)
+	return err
+}
+
+// reportJobText sends text a stage produced to the job's stream before the
+// note is saved
+func reportJobText(jobID, event, text string) error {
+	err := recordJobEvent(db, jobID, event, fiber.Map{"text": text})
+	jobEvents.publish(jobID)
+	return err
+}
+
+// jobResult is what the ML stages produced for a note
+type jobResult struct {
+	Text       string
+	OCRBlocks  []Block
+	Transcript *string
+	Summary    string
+	Tags       []string
+	QAPairs    []QAPair
+}
+
+// uploadKind returns the media type of the staged file, sniffing it when
+// the client did not say
+func uploadKind(path, contentType string) (string, error) {
+	if contentType != "" && contentType != "application/octet-stream" {
+		return contentType, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// readTextUpload reads a text upload of at most maxTextUploadBytes
+func readTextUpload(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxTextUploadBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxTextUploadBytes {
+		return "", fmt.Errorf("%w: text larger than %d MiB", errUnprocessable, maxTextUploadBytes>>20)
+	}
+	return string(data), nil
+}
+
+func runJob(job *claimedJob) error {
+	path := uploadPath(job.UserID, job.ID)
+	kind, err := uploadKind(path, job.ContentType)
+	if err != nil {
+		return err
+	}
+
+	var result jobResult
+	switch {
+	case strings.HasPrefix(kind, "image/"):
+		if err := setJobStage(job, stageOCR); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		result.OCRBlocks, err = mlClient.OCR(f, job.Filename, job.UserID)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		texts := make([]string, len(result.OCRBlocks))
+		for i, block := range result.OCRBlocks {
+			texts[i] = block.Text
+		}
+		result.Text = strings.Join(texts, " ")
+		if err := reportJobText(job.ID, jobEventText, result.Text); err != nil {
+			return err
+		}
+	case strings.HasPrefix(kind, "audio/"):
+		if err := setJobStage(job, stageASR); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		transcript, err := mlClient.ASR(f, job.Filename, job.UserID)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		result.Transcript = &transcript
+		result.Text = transcript
+		if err := reportJobText(job.ID, jobEventTranscript, transcript); err != nil {
+			return err
+		}
+	case strings.HasPrefix(kind, "text/"):
+		if result.Text, err = readTextUpload(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unsupported file type %s", errUnprocessable, kind)
+	}
+	if strings.TrimSpace(result.Text) == "" {
+		return fmt.Errorf("%w: no text found", errUnprocessable)
+	}
+
+	if err := setJobStage(job, stageSummarise); err != nil {
+		return err
+	}
+	if result.Summary, err = mlClient.Summarize(result.Text); err != nil {
+		return err
+	}
+	if err := reportJobText(job.ID, jobEventSummary, result.Summary); err != nil {
+		return err
+	}
+	if result.Tags, err = mlClient.Keyphrases(result.Text, maxNoteKeyphrases); err != nil {
+		return err
+	}
+
+	if err := setJobStage(job, stageQA); err != nil {
+		return err
+	}
+	if result.QAPairs, err = mlClient.GenerateQA(result.Text, maxQuizQuestions); err != nil {
+		return err
+	}
+
+	return storeJobNote(job, kind, result)
+}
+
+// storeJobNote saves the note with everything generated from it and
+// completes the job in one transaction
+func storeJobNote(job *claimedJob, contentType string, result jobResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	title := strings.TrimSuffix(filepath.Base(job.Filename), filepath.Ext(job.Filename))
+	var noteID string
+	err = tx.QueryRow(
+		"INSERT INTO notes (user_id, notebook_id, title, content, summary) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		job.UserID,
+		job.NotebookID,
+		title,
+		result.Text,
+		result.Summary,
+	).Scan(&noteID)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range result.OCRBlocks {
+		bbox, _ := json.Marshal(map[string][]float64{"coords": block.BBox})
+		if _, err := tx.Exec("INSERT INTO ocr_blocks (note_id, text, bbox) VALUES ($1, $2, $3)", noteID, block.Text, bbox); err != nil {
+			return err
+		}
+	}
+	if result.Transcript != nil {
+		if _, err := tx.Exec("INSERT INTO audio_notes (note_id, transcript) VALUES ($1, $2)", noteID, *result.Transcript); err != nil {
+			return err
+		}
+	}
+	for _, pair := range result.QAPairs {
+		if _, err := tx.Exec("INSERT INTO quiz_cards (note_id, question, answer) VALUES ($1, $2, $3)", noteID, pair.Q, pair.A); err != nil {
+			return err
+		}
+	}
+
+	tags := []string{}
+	for _, tag := range result.Tags {
+		tag = normalizeTag(tag)
+		if validateTag(tag) == "" && !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		_, err := tx.Exec(
+			"INSERT INTO tags (note_id, tag) SELECT $1, unnest($2::text[]) ON CONFLICT (note_id, tag) DO NOTHING",
+			noteID,
+			pq.Array(tags),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The staged upload is kept as the note's original file
+	_, err = tx.Exec(
+		`INSERT INTO note_files (id, note_id, user_id, filename, content_type, size_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		job.ID,
+		noteID,
+		job.UserID,
+		filepath.Base(job.Filename),
+		contentType,
+		job.SizeBytes,
+	)
+	if err != nil {
+		return err
+	}
+
+	// A run that lost its lease rolls the note back
+	err = leaseHeld(tx.Exec(`
+		UPDATE jobs SET status = 'succeeded', note_id = $2, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = 'running' AND attempts = $3
+	`, job.ID, noteID, job.Attempts))
+	if err != nil {
+		return err
+	}
+
+	// The stream ends with the note as GET /api/notes/:id returns it
+	note, err := scanNote(tx.QueryRow(noteSelect+" WHERE n.id = $1 GROUP BY n.id", noteID))
+	if err != nil {
+		return err
+	}
+	if err := recordJobEvent(tx, job.ID, jobEventNote, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
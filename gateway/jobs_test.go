@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJobID = "5e3b2c1d-8f7a-4b6c-9d0e-1f2a3b4c5d6e"
+
+var jobColumns = []string{"id", "status", "stage", "note_id", "error", "filename", "content_type", "size_bytes", "created_at", "started_at", "finished_at"}
+
+// fakeMLServer stands in for the ML service's stage endpoints
+func fakeMLServer(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	mlClient = newHTTPMLClient(server.URL, 5*time.Second)
+}
+
+// stageJob writes an upload where the worker expects it
+func stageJob(t *testing.T, userID string, data []byte) *claimedJob {
+	uploadDir = t.TempDir()
+	path := uploadPath(userID, testJobID)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	return &claimedJob{
+		ID:          testJobID,
+		UserID:      userID,
+		Filename:    "lecture 3.png",
+		ContentType: "image/png",
+		SizeBytes:   int64(len(data)),
+		Attempts:    1,
+	}
+}
+
+func expectJobStage(mock sqlmock.Sqlmock, stage string) {
+	mock.ExpectExec("UPDATE jobs SET stage = \\$2").
+		WithArgs(testJobID, stage, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectJobEvent(mock sqlmock.Sqlmock, event, data string) {
+	mock.ExpectExec("INSERT INTO job_events").
+		WithArgs(testJobID, event, []byte(data)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestLoadJobWorkers(t *testing.T) {
+	t.Setenv("JOB_WORKERS", "")
+	n, err := loadJobWorkers()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultJobWorkers, n)
+
+	t.Setenv("JOB_WORKERS", "4")
+	n, err = loadJobWorkers()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	t.Setenv("JOB_WORKERS", "-1")
+	_, err = loadJobWorkers()
+	assert.Error(t, err)
+}
+
+func TestGetJob(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/jobs/:id", withUser("user-1"), getJob)
+
+	now := time.Now()
+	mock.ExpectQuery("FROM jobs WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testJobID, "user-1").
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(testJobID, "succeeded", "qa", testNoteID, "", "scan.png", "image/png", 12, now, now, now))
+
+	req := httptest.NewRequest("GET", "/api/jobs/"+testJobID, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var job Job
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, "succeeded", job.Status)
+	assert.Equal(t, testNoteID, job.NoteID)
+	assert.NotNil(t, job.FinishedAt)
+}
+
+func TestGetJob_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/jobs/:id", withUser("user-1"), getJob)
+
+	// Another user's job looks the same as a missing one
+	mock.ExpectQuery("FROM jobs WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testJobID, "user-1").
+		WillReturnRows(sqlmock.NewRows(jobColumns))
+
+	for _, id := range []string{testJobID, "not-a-uuid"} {
+		req := httptest.NewRequest("GET", "/api/jobs/"+id, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, id)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimJob(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+
+	claim := "UPDATE jobs SET status = 'running'.* FOR UPDATE SKIP LOCKED"
+	mock.ExpectQuery(claim).
+		WithArgs(jobLease.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "notebook_id", "filename", "content_type", "size_bytes", "attempts"}).
+			AddRow(testJobID, "user-1", nil, "scan.png", "image/png", 12, 1))
+	mock.ExpectQuery(claim).
+		WithArgs(jobLease.Seconds()).
+		WillReturnError(sql.ErrNoRows)
+
+	job, err := claimJob()
+	assert.NoError(t, err)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, testJobID, job.ID)
+		assert.False(t, job.NotebookID.Valid)
+	}
+
+	// Nothing queued
+	job, err = claimJob()
+	assert.NoError(t, err)
+	assert.Nil(t, job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessJob(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte("lecture scan"))
+
+	var paths []string
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/ocr":
+			json.NewEncoder(w).Encode(OCRResponse{Blocks: []Block{{Text: "Mitochondria", BBox: []float64{1, 2, 3, 4}}}})
+		case "/summarize":
+			json.NewEncoder(w).Encode(SummaryResponse{Summary: "Energy"})
+		case "/keyphrases":
+			json.NewEncoder(w).Encode(KeyphraseResponse{Keyphrases: []string{"Mitochondria", " mitochondria "}})
+		case "/generate-qa":
+			json.NewEncoder(w).Encode(QAResponse{QAPairs: []QAPair{{Q: "Powerhouse?", A: "Mitochondria"}}})
+		}
+	})
+
+	// Each stage's text is streamed as soon as it is known
+	expectJobStage(mock, stageOCR)
+	expectJobEvent(mock, jobEventText, `{"text":"Mitochondria"}`)
+	expectJobStage(mock, stageSummarise)
+	expectJobEvent(mock, jobEventSummary, `{"text":"Energy"}`)
+	expectJobStage(mock, stageQA)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO notes \\(user_id, notebook_id, title, content, summary\\)").
+		WithArgs("user-1", sql.NullString{}, "lecture 3", "Mitochondria", "Energy").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testNoteID))
+	mock.ExpectExec("INSERT INTO ocr_blocks").
+		WithArgs(testNoteID, "Mitochondria", []byte(`{"coords":[1,2,3,4]}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO quiz_cards").
+		WithArgs(testNoteID, "Powerhouse?", "Mitochondria").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO tags").
+		WithArgs(testNoteID, pq.Array([]string{"mitochondria"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_files").
+		WithArgs(testJobID, testNoteID, "user-1", "lecture 3.png", "image/png", 12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE jobs SET status = 'succeeded', note_id = \\$2").
+		WithArgs(testJobID, testNoteID, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	now := time.Now()
+	mock.ExpectQuery("WHERE n.id = \\$1 GROUP BY n.id").
+		WithArgs(testNoteID).
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow(testNoteID, "lecture 3", "Mitochondria", "Energy", now, now, "[]", "{mitochondria}", nil))
+	mock.ExpectExec("INSERT INTO job_events").
+		WithArgs(testJobID, jobEventNote, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []string{"/ocr", "/summarize", "/keyphrases", "/generate-qa"}, paths)
+
+	// The staged upload is now the note's original
+	_, err := os.Stat(uploadPath("user-1", testJobID))
+	assert.NoError(t, err)
+}
+
+func TestProcessJob_RetriesMLErrors(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte("lecture scan"))
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	expectJobStage(mock, stageOCR)
+	mock.ExpectExec("UPDATE jobs SET status = 'queued'").
+		WithArgs(testJobID, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// The last attempt fails the job for good
+	job.Attempts = maxJobAttempts
+	expectJobStage(mock, stageOCR)
+	mock.ExpectExec("UPDATE jobs SET status = 'failed'").
+		WithArgs(testJobID, maxJobAttempts, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_, err := os.Stat(uploadPath("user-1", testJobID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProcessJob_RejectedByML(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte("lecture scan"))
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("image too small"))
+	})
+
+	// The service refusing the input fails the job on its first attempt
+	expectJobStage(mock, stageOCR)
+	mock.ExpectExec("UPDATE jobs SET status = 'failed'").
+		WithArgs(testJobID, 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_, err := os.Stat(uploadPath("user-1", testJobID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProcessJob_LeaseLost(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte("Cells divide"))
+	job.Filename, job.ContentType = "lecture.txt", "text/plain"
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/summarize":
+			json.NewEncoder(w).Encode(SummaryResponse{Summary: "Mitosis"})
+		case "/keyphrases":
+			json.NewEncoder(w).Encode(KeyphraseResponse{Keyphrases: []string{}})
+		case "/generate-qa":
+			json.NewEncoder(w).Encode(QAResponse{QAPairs: []QAPair{}})
+		}
+	})
+
+	// Another worker took the job over, so this run stops at its next stage
+	mock.ExpectExec("UPDATE jobs SET stage = \\$2").
+		WithArgs(testJobID, stageSummarise, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// A run that finishes late leaves the other run's job as it is
+	expectJobStage(mock, stageSummarise)
+	expectJobEvent(mock, jobEventSummary, `{"text":"Mitosis"}`)
+	expectJobStage(mock, stageQA)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO notes").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testNoteID))
+	mock.ExpectExec("INSERT INTO note_files").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE jobs SET status = 'succeeded'").
+		WithArgs(testJobID, testNoteID, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Nor does it fail the job or remove the upload the other run is using
+	job.ContentType = "application/zip"
+	mock.ExpectExec("UPDATE jobs SET status = 'failed'").
+		WithArgs(testJobID, 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err := os.Stat(uploadPath("user-1", testJobID))
+	assert.NoError(t, err)
+}
+
+func TestProcessJob_Unsupported(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte{0x50, 0x4b, 0x03, 0x04, 0x14, 0x00})
+	job.ContentType = "application/octet-stream"
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected ML call %s", r.URL.Path)
+	})
+
+	// Sniffed as a zip, which no retry will fix
+	mock.ExpectExec("UPDATE jobs SET status = 'failed'").
+		WithArgs(testJobID, 1, "upload cannot be processed: unsupported file type application/zip").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessJob_TextTooLarge(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", bytes.Repeat([]byte("a"), maxTextUploadBytes+1))
+	job.Filename, job.ContentType = "lecture.txt", "text/plain"
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected ML call %s", r.URL.Path)
+	})
+
+	mock.ExpectExec("UPDATE jobs SET status = 'failed'").
+		WithArgs(testJobID, 1, "upload cannot be processed: text larger than 10 MiB").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessJob_Audio(t *testing.T) {
+	_, mock := setupTestApp()
+	defer db.Close()
+	job := stageJob(t, "user-1", []byte("ID3 lecture"))
+	job.Filename, job.ContentType = "lecture.mp3", "audio/mpeg"
+	fakeMLServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/asr":
+			json.NewEncoder(w).Encode(ASRResponse{Transcript: "Cells divide"})
+		case "/summarize":
+			json.NewEncoder(w).Encode(SummaryResponse{Summary: "Mitosis"})
+		case "/keyphrases":
+			json.NewEncoder(w).Encode(KeyphraseResponse{Keyphrases: []string{}})
+		case "/generate-qa":
+			json.NewEncoder(w).Encode(QAResponse{QAPairs: []QAPair{}})
+		}
+	})
+
+	// The transcript is streamed before the summary is asked for
+	expectJobStage(mock, stageASR)
+	expectJobEvent(mock, jobEventTranscript, `{"text":"Cells divide"}`)
+	expectJobStage(mock, stageSummarise)
+	expectJobEvent(mock, jobEventSummary, `{"text":"Mitosis"}`)
+	expectJobStage(mock, stageQA)
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO notes").
+		WithArgs("user-1", sql.NullString{}, "lecture", "Cells divide", "Mitosis").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testNoteID))
+	mock.ExpectExec("INSERT INTO audio_notes").
+		WithArgs(testNoteID, "Cells divide").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO note_files").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE jobs SET status = 'succeeded'").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	now := time.Now()
+	mock.ExpectQuery("WHERE n.id = \\$1 GROUP BY n.id").
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow(testNoteID, "lecture", "Cells divide", "Mitosis", now, now, "[]", "{}", nil))
+	mock.ExpectExec("INSERT INTO job_events").
+		WithArgs(testJobID, jobEventNote, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	processJob(job)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const minSecretLength = 32
+
+// signingKey is a JWT key identified by its kid. Keys kept only to verify
+// tokens issued before a rotation have no signKey.
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keyring signs tokens with the current key and verifies them against the
+// current and previous keys.
+type keyring struct {
+	current *signingKey
+	keys    map[string]*signingKey
+}
+
+// JWK is the public part of a verification key as published in the JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+var signingKeys *keyring
+
+func newKeyring(current *signingKey, previous ...*signingKey) *keyring {
+	k := &keyring{
+		current: current,
+		keys:    map[string]*signingKey{current.id: current},
+	}
+	for _, key := range previous {
+		if _, exists := k.keys[key.id]; !exists {
+			k.keys[key.id] = key
+		}
+	}
+	return k
+}
+
+// loadKeyring builds the keyring from the environment:
+//
+//	JWT_PRIVATE_KEY_FILE    PEM Ed25519 or RSA key, signs with EdDSA or RS256
+//	JWT_SECRET(_FILE)       HS256 secret, used when no private key is set
+//	JWT_KEY_ID              overrides the derived kid of the current key
+//	JWT_PREVIOUS_SECRETS    comma-separated HS256 secrets still accepted
+//	JWT_PREVIOUS_KEY_FILES  comma-separated PEM keys still accepted
+//
+// A previous key given as kid:secret or kid:path keeps the kid it was
+// issued under with JWT_KEY_ID; a bare one gets the derived kid.
+func loadKeyring() (*keyring, error) {
+	var current *signingKey
+	var err error
+
+	if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+		current, err = loadPEMKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if current.signKey == nil {
+			return nil, fmt.Errorf("%s does not contain a private key", path)
+		}
+	} else {
+		secret := os.Getenv("JWT_SECRET")
+		if path := os.Getenv("JWT_SECRET_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET, JWT_SECRET_FILE or JWT_PRIVATE_KEY_FILE must be set")
+		}
+		if len(secret) < minSecretLength {
+			log.Printf("[WARN] JWT secret is shorter than %d bytes", minSecretLength)
+		}
+		current = newHMACKey(secret)
+	}
+	if kid := os.Getenv("JWT_KEY_ID"); kid != "" {
+		current.id = kid
+	}
+
+	var previous []*signingKey
+	for _, item := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+		kid, secret := splitKeyID(item)
+		key := newHMACKey(secret)
+		if kid != "" {
+			key.id = kid
+		}
+		previous = append(previous, key)
+	}
+	for _, item := range splitList(os.Getenv("JWT_PREVIOUS_KEY_FILES")) {
+		kid, path := splitKeyID(item)
+		key, err := loadPEMKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if kid != "" {
+			key.id = kid
+		}
+		previous = append(previous, key)
+	}
+
+	return newKeyring(current, previous...), nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitKeyID separates the kid from a previous key written as kid:value.
+// A secret that itself contains ":" must be given with its kid.
+func splitKeyID(item string) (kid, value string) {
+	if kid, value, ok := strings.Cut(item, ":"); ok && kid != "" && value != "" {
+		return kid, value
+	}
+	return "", item
+}
+
+func newHMACKey(secret string) *signingKey {
+	sum := sha256.Sum256([]byte("kid:" + secret))
+	return &signingKey{
+		id:        "hs-" + hex.EncodeToString(sum[:8]),
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// loadPEMKey reads an Ed25519 or RSA key, private or public, from a PEM file
+func loadPEMKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s: %w", path, err)
+	}
+	return newAsymmetricKey(parsed)
+}
+
+func newAsymmetricKey(parsed interface{}) (*signingKey, error) {
+	key := &signingKey{}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.method, key.signKey, key.verifyKey = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.verifyKey = jwt.SigningMethodEdDSA, k
+	case *rsa.PrivateKey:
+		key.method, key.signKey, key.verifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verifyKey = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return key, nil
+}
+
+// sign issues a token with the current key and its kid header
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.method, claims)
+	token.Header["kid"] = k.current.id
+	return token.SignedString(k.current.signKey)
+}
+
+// keyfunc selects the verification key by kid, refusing tokens whose
+// algorithm differs from the one the key was issued for.
+func (k *keyring) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// jwks returns the public keys other services can verify our tokens with.
+// HS256 secrets are never published.
+func (k *keyring) jwks() []JWK {
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		switch pub := key.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP",
+				Kid: key.id,
+				Alg: key.method.Alg(),
+				Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA",
+				Kid: key.id,
+				Alg: key.method.Alg(),
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks
+}
+
+func getJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": signingKeys.jwks()})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func testClaims() Claims {
+	return Claims{
+		UserID:    "user-1",
+		TokenType: accessTokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+}
+
+func verify(k *keyring, token string) error {
+	_, err := jwt.ParseWithClaims(token, &Claims{}, k.keyfunc)
+	return err
+}
+
+func TestLoadKeyring_RequiresSecret(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SECRET_FILE", "")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", "")
+
+	_, err := loadKeyring()
+	assert.Error(t, err)
+}
+
+func TestLoadKeyring_SecretFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte("file-secret-file-secret-file-secret\n"), 0600))
+	t.Setenv("JWT_SECRET", "ignored")
+	t.Setenv("JWT_SECRET_FILE", path)
+
+	k, err := loadKeyring()
+	require.NoError(t, err)
+	assert.Equal(t, newHMACKey("file-secret-file-secret-file-secret").id, k.current.id)
+}
+
+func TestKeyring_SignsWithKid(t *testing.T) {
+	t.Setenv("JWT_SECRET", "current-secret-current-secret-current")
+	t.Setenv("JWT_KEY_ID", "2026-10")
+
+	k, err := loadKeyring()
+	require.NoError(t, err)
+
+	token, err := k.sign(testClaims())
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "2026-10", parsed.Header["kid"])
+	assert.NoError(t, verify(k, token))
+}
+
+func TestKeyring_VerifiesPreviousKeys(t *testing.T) {
+	old := newKeyring(newHMACKey("old-secret-old-secret-old-secret-old"))
+	oldToken, err := old.sign(testClaims())
+	require.NoError(t, err)
+
+	t.Setenv("JWT_SECRET", "new-secret-new-secret-new-secret-new")
+	t.Setenv("JWT_PREVIOUS_SECRETS", "old-secret-old-secret-old-secret-old")
+	rotated, err := loadKeyring()
+	require.NoError(t, err)
+	assert.NoError(t, verify(rotated, oldToken))
+
+	// Once the old secret is retired its tokens are rejected
+	t.Setenv("JWT_PREVIOUS_SECRETS", "")
+	retired, err := loadKeyring()
+	require.NoError(t, err)
+	assert.Error(t, verify(retired, oldToken))
+}
+
+func TestKeyring_VerifiesPreviousKeysByKid(t *testing.T) {
+	// Tokens issued while the key was current under JWT_KEY_ID
+	t.Setenv("JWT_SECRET", "old-secret-old-secret-old-secret-old")
+	t.Setenv("JWT_KEY_ID", "2026-09")
+	old, err := loadKeyring()
+	require.NoError(t, err)
+	oldToken, err := old.sign(testClaims())
+	require.NoError(t, err)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	oldPEMKey, err := newAsymmetricKey(priv)
+	require.NoError(t, err)
+	oldPEMKey.id = "2026-08"
+	oldPEMToken, err := newKeyring(oldPEMKey).sign(testClaims())
+	require.NoError(t, err)
+
+	// After rotation they still resolve to the key that signed them
+	t.Setenv("JWT_SECRET", "new-secret-new-secret-new-secret-new")
+	t.Setenv("JWT_KEY_ID", "2026-10")
+	t.Setenv("JWT_PREVIOUS_SECRETS", "2026-09:old-secret-old-secret-old-secret-old")
+	t.Setenv("JWT_PREVIOUS_KEY_FILES", "2026-08:"+writePEM(t, "PRIVATE KEY", der))
+	rotated, err := loadKeyring()
+	require.NoError(t, err)
+	assert.NoError(t, verify(rotated, oldToken))
+	assert.NoError(t, verify(rotated, oldPEMToken))
+	assert.Contains(t, rotated.keys, "2026-09")
+	assert.Contains(t, rotated.keys, "2026-08")
+}
+
+func TestKeyring_RejectsMissingKid(t *testing.T) {
+	k := newKeyring(newHMACKey("some-secret-some-secret-some-secret"))
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).
+		SignedString([]byte("some-secret-some-secret-some-secret"))
+	require.NoError(t, err)
+	assert.Error(t, verify(k, token))
+}
+
+func TestKeyring_EdDSA(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePEM(t, "PRIVATE KEY", der))
+
+	k, err := loadKeyring()
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", k.current.method.Alg())
+
+	token, err := k.sign(testClaims())
+	require.NoError(t, err)
+	assert.NoError(t, verify(k, token))
+
+	jwks := k.jwks()
+	require.Len(t, jwks, 1)
+	assert.Equal(t, "OKP", jwks[0].Kty)
+	assert.Equal(t, k.current.id, jwks[0].Kid)
+}
+
+func TestKeyring_RS256WithPreviousPublicKey(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	oldSigningKey, err := newAsymmetricKey(oldKey)
+	require.NoError(t, err)
+	oldToken, err := newKeyring(oldSigningKey).sign(testClaims())
+	require.NoError(t, err)
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	require.NoError(t, err)
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(newKey)))
+	t.Setenv("JWT_PREVIOUS_KEY_FILES", writePEM(t, "PUBLIC KEY", pubDER))
+
+	k, err := loadKeyring()
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", k.current.method.Alg())
+	assert.NoError(t, verify(k, oldToken))
+	assert.Len(t, k.jwks(), 2)
+}
+
+func TestKeyring_RejectsAlgorithmConfusion(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := newAsymmetricKey(priv)
+	require.NoError(t, err)
+	k := newKeyring(key)
+
+	// HS256 token keyed with the published public key under the RSA kid
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = key.id
+	token, err := forged.SignedString(pubDER)
+	require.NoError(t, err)
+	assert.Error(t, verify(k, token))
+}
+
+func TestGetJWKS(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := newAsymmetricKey(priv)
+	require.NoError(t, err)
+	signingKeys = newKeyring(key, newHMACKey("hidden-secret-hidden-secret-hidden"))
+
+	app := fiber.New()
+	app.Get("/.well-known/jwks.json", getJWKS)
+	resp, err := app.Test(httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, key.id, result.Keys[0].Kid)
+	assert.Equal(t, "EdDSA", result.Keys[0].Alg)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Attempts is the failed login history of a single key
+type Attempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// withFailure counts a failure at now, starting over when the previous
+// failure is older than window
+func (a Attempts) withFailure(now time.Time, window time.Duration) Attempts {
+	if now.Sub(a.LastFailure) > window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+	return a
+}
+
+// withoutFailure takes back a failure counted at at, going back to the
+// previous failure time unless a later failure was counted since
+func (a Attempts) withoutFailure(at time.Time, prev Attempts) Attempts {
+	if a.Failures > 0 {
+		a.Failures--
+	}
+	if a.LastFailure.Equal(at) {
+		a.LastFailure = prev.LastFailure
+	}
+	return a
+}
+
+// AttemptStore tracks failed login attempts per key (an email or an IP)
+type AttemptStore interface {
+	Get(ctx context.Context, key string) (Attempts, error)
+	// Reserve counts an attempt at now as a failure unless policy makes the
+	// key wait, in which case it returns the wait and counts nothing. The
+	// check and the count are atomic, so concurrent attempts cannot all
+	// pass on the same history. prev is the history before the attempt.
+	Reserve(ctx context.Context, key string, now time.Time, policy LimitPolicy) (wait time.Duration, prev Attempts, err error)
+	// Release takes back an attempt reserved at at
+	Release(ctx context.Context, key string, at time.Time, prev Attempts) error
+	Reset(ctx context.Context, key string) error
+}
+
+// LimitPolicy describes how failures turn into waiting time: the first
+// FreeAttempts failures cost nothing, later ones double the delay from
+// BaseDelay up to MaxDelay, and LockoutThreshold failures lock the key for
+// LockoutDuration. Failures older than Window are forgotten.
+type LimitPolicy struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	Window           time.Duration
+}
+
+var (
+	// Per account: a handful of typos, then back off quickly
+	emailLimitPolicy = LimitPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+		Window:           24 * time.Hour,
+	}
+	// Per IP: campus networks put many students behind one address
+	ipLimitPolicy = LimitPolicy{
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  time.Hour,
+		Window:           time.Hour,
+	}
+)
+
+// retryAfter returns how long a key with the given history must wait
+func (p LimitPolicy) retryAfter(attempts Attempts, now time.Time) time.Duration {
+	if attempts.Failures == 0 || now.Sub(attempts.LastFailure) > p.Window {
+		return 0
+	}
+
+	var delay time.Duration
+	switch {
+	case attempts.Failures >= p.LockoutThreshold:
+		delay = p.LockoutDuration
+	case attempts.Failures > p.FreeAttempts:
+		exponent := float64(attempts.Failures - p.FreeAttempts - 1)
+		delay = time.Duration(math.Min(
+			float64(p.BaseDelay)*math.Pow(2, exponent),
+			float64(p.MaxDelay),
+		))
+	default:
+		return 0
+	}
+
+	if wait := attempts.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// LoginLimiter applies the email and IP policies to login attempts
+type LoginLimiter struct {
+	store AttemptStore
+	email LimitPolicy
+	ip    LimitPolicy
+	now   func() time.Time
+}
+
+var loginLimiter = newLoginLimiter(newMemoryAttemptStore())
+
+func newLoginLimiter(store AttemptStore) *LoginLimiter {
+	return &LoginLimiter{
+		store: store,
+		email: emailLimitPolicy,
+		ip:    ipLimitPolicy,
+		now:   time.Now,
+	}
+}
+
+// LoginAttempt is an attempt reserved for an email and IP. It counts as a
+// failure until it succeeds or is released.
+type LoginAttempt struct {
+	limiter   *LoginLimiter
+	email     string
+	ip        string
+	at        time.Time
+	emailPrev Attempts
+	ipPrev    Attempts
+}
+
+// Reserve counts an attempt for the email and the IP before the
+// credentials are checked, so concurrent guesses cannot slip past the
+// limits together. When either must wait, nothing is counted and the wait
+// is returned instead.
+func (l *LoginLimiter) Reserve(ctx context.Context, email, ip string) (*LoginAttempt, time.Duration, error) {
+	attempt := &LoginAttempt{limiter: l, email: email, ip: ip, at: l.now()}
+
+	emailWait, emailPrev, err := l.store.Reserve(ctx, "email:"+email, attempt.at, l.email)
+	if err != nil {
+		return nil, 0, err
+	}
+	attempt.emailPrev = emailPrev
+	ipWait, ipPrev, err := l.store.Reserve(ctx, "ip:"+ip, attempt.at, l.ip)
+	if err != nil {
+		if emailWait == 0 {
+			attempt.releaseEmail(ctx)
+		}
+		return nil, 0, err
+	}
+	attempt.ipPrev = ipPrev
+
+	wait := emailWait
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait == 0 {
+		return attempt, 0, nil
+	}
+	// Only the key that was let through was counted
+	if emailWait == 0 {
+		err = attempt.releaseEmail(ctx)
+	}
+	if ipWait == 0 {
+		err = attempt.releaseIP(ctx)
+	}
+	return nil, wait, err
+}
+
+// Succeed clears the account's failures and takes back the IP's count.
+// The IP keeps its earlier history so one valid account cannot be used to
+// reset guessing against others.
+func (a *LoginAttempt) Succeed(ctx context.Context) error {
+	if err := a.limiter.store.Reset(ctx, "email:"+a.email); err != nil {
+		return err
+	}
+	return a.releaseIP(ctx)
+}
+
+// Release takes the attempt back, for outcomes that are neither a failure
+// nor a login
+func (a *LoginAttempt) Release(ctx context.Context) error {
+	if err := a.releaseEmail(ctx); err != nil {
+		return err
+	}
+	return a.releaseIP(ctx)
+}
+
+func (a *LoginAttempt) releaseEmail(ctx context.Context) error {
+	return a.limiter.store.Release(ctx, "email:"+a.email, a.at, a.emailPrev)
+}
+
+func (a *LoginAttempt) releaseIP(ctx context.Context) error {
+	return a.limiter.store.Release(ctx, "ip:"+a.ip, a.at, a.ipPrev)
+}
+
+// memoryAttemptStore keeps attempts in process, for tests and single
+// instance development
+type memoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+}
+
+func newMemoryAttemptStore() *memoryAttemptStore {
+	return &memoryAttemptStore{attempts: make(map[string]Attempts)}
+}
+
+func (s *memoryAttemptStore) Get(ctx context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+func (s *memoryAttemptStore) Reserve(ctx context.Context, key string, now time.Time, policy LimitPolicy) (time.Duration, Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.attempts[key]
+	if wait := policy.retryAfter(prev, now); wait > 0 {
+		return wait, prev, nil
+	}
+	s.attempts[key] = prev.withFailure(now, policy.Window)
+	return 0, prev, nil
+}
+
+func (s *memoryAttemptStore) Release(ctx context.Context, key string, at time.Time, prev Attempts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempts, ok := s.attempts[key]; ok {
+		s.attempts[key] = attempts.withoutFailure(at, prev)
+	}
+	return nil
+}
+
+func (s *memoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// postgresAttemptStore shares attempts between gateway instances through
+// the login_attempts table
+type postgresAttemptStore struct {
+	db *sql.DB
+}
+
+func newPostgresAttemptStore(db *sql.DB) *postgresAttemptStore {
+	return &postgresAttemptStore{db: db}
+}
+
+func (s *postgresAttemptStore) Get(ctx context.Context, key string) (Attempts, error) {
+	var attempts Attempts
+	err := s.db.QueryRowContext(ctx,
+		"SELECT failures, last_failure_at FROM login_attempts WHERE key = $1",
+		key,
+	).Scan(&attempts.Failures, &attempts.LastFailure)
+	if err == sql.ErrNoRows {
+		return Attempts{}, nil
+	}
+	return attempts, err
+}
+
+// Reserve locks the key's row for the check and the count. A key without
+// history gets an empty row first, so there is always a row to lock.
+func (s *postgresAttemptStore) Reserve(ctx context.Context, key string, now time.Time, policy LimitPolicy) (time.Duration, Attempts, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, Attempts{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 0, $2) ON CONFLICT (key) DO NOTHING",
+		key,
+		now,
+	)
+	if err != nil {
+		return 0, Attempts{}, err
+	}
+	var prev Attempts
+	err = tx.QueryRowContext(ctx,
+		"SELECT failures, last_failure_at FROM login_attempts WHERE key = $1 FOR UPDATE",
+		key,
+	).Scan(&prev.Failures, &prev.LastFailure)
+	if err != nil {
+		return 0, Attempts{}, err
+	}
+
+	if wait := policy.retryAfter(prev, now); wait > 0 {
+		return wait, prev, tx.Commit()
+	}
+	next := prev.withFailure(now, policy.Window)
+	_, err = tx.ExecContext(ctx,
+		"UPDATE login_attempts SET failures = $2, last_failure_at = $3 WHERE key = $1",
+		key,
+		next.Failures,
+		next.LastFailure,
+	)
+	if err != nil {
+		return 0, Attempts{}, err
+	}
+	return 0, prev, tx.Commit()
+}
+
+func (s *postgresAttemptStore) Release(ctx context.Context, key string, at time.Time, prev Attempts) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE login_attempts SET
+			failures = GREATEST(failures - 1, 0),
+			last_failure_at = CASE WHEN last_failure_at = $2 THEN $3 ELSE last_failure_at END
+		WHERE key = $1
+	`, key, at, prev.LastFailure)
+	return err
+}
+
+func (s *postgresAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
+
+// auditLoginFailure records a failed or blocked login. Auditing must not
+// change the outcome of the login, so errors are only logged.
+func auditLoginFailure(email, ip, userAgent, reason string) {
+	_, err := db.Exec(
+		"INSERT INTO login_audit (email, ip_address, user_agent, reason) VALUES ($1, $2, $3, $4)",
+		email,
+		ip,
+		userAgent,
+		reason,
+	)
+	if err != nil {
+		log.Printf("[ERROR] Failed to audit login failure: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLimitPolicy_RetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		attempts Attempts
+		want     time.Duration
+	}{
+		{"no failures", Attempts{}, 0},
+		{"free attempts", Attempts{Failures: 3, LastFailure: now}, 0},
+		{"first backoff", Attempts{Failures: 4, LastFailure: now}, time.Second},
+		{"doubling", Attempts{Failures: 6, LastFailure: now}, 4 * time.Second},
+		{"last before lockout", Attempts{Failures: 9, LastFailure: now}, 32 * time.Second},
+		{"lockout", Attempts{Failures: 10, LastFailure: now}, 30 * time.Minute},
+		{"partly waited", Attempts{Failures: 5, LastFailure: now.Add(-time.Second)}, time.Second},
+		{"backoff elapsed", Attempts{Failures: 5, LastFailure: now.Add(-time.Minute)}, 0},
+		{"outside window", Attempts{Failures: 50, LastFailure: now.Add(-25 * time.Hour)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, emailLimitPolicy.retryAfter(tt.attempts, now))
+		})
+	}
+}
+
+func TestLimitPolicy_MaxDelay(t *testing.T) {
+	now := time.Now()
+	attempts := Attempts{Failures: ipLimitPolicy.LockoutThreshold - 1, LastFailure: now}
+	assert.Equal(t, ipLimitPolicy.MaxDelay, ipLimitPolicy.retryAfter(attempts, now))
+}
+
+func TestLoginLimiter_LocksOutAndResets(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newLoginLimiter(newMemoryAttemptStore())
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < emailLimitPolicy.LockoutThreshold; i++ {
+		if i > 0 {
+			now = now.Add(emailLimitPolicy.MaxDelay)
+		}
+		attempt, wait, err := limiter.Reserve(ctx, "ada@example.com", "10.0.0.1")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+		require.NotNil(t, attempt)
+	}
+	attempt, wait, err := limiter.Reserve(ctx, "ada@example.com", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Nil(t, attempt)
+	assert.Equal(t, emailLimitPolicy.LockoutDuration, wait)
+
+	// The lockout expires on its own
+	now = now.Add(emailLimitPolicy.LockoutDuration)
+	attempt, wait, err = limiter.Reserve(ctx, "ada@example.com", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// Success clears the account but not the IP's earlier failures
+	require.NoError(t, attempt.Succeed(ctx))
+	emailAttempts, _ := limiter.store.Get(ctx, "email:ada@example.com")
+	ipAttempts, _ := limiter.store.Get(ctx, "ip:10.0.0.1")
+	otherIPAttempts, _ := limiter.store.Get(ctx, "ip:10.0.0.2")
+	assert.Zero(t, emailAttempts.Failures)
+	assert.Equal(t, emailLimitPolicy.LockoutThreshold, ipAttempts.Failures)
+	assert.Zero(t, otherIPAttempts.Failures)
+}
+
+func TestLoginLimiter_IPAcrossAccounts(t *testing.T) {
+	ctx := context.Background()
+	limiter := newLoginLimiter(newMemoryAttemptStore())
+
+	// Spraying one guess at many accounts still trips the IP limit
+	for i := 0; i <= ipLimitPolicy.FreeAttempts; i++ {
+		_, wait, err := limiter.Reserve(ctx, strings.Repeat("a", i+1)+"@example.com", "10.0.0.9")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+	attempt, wait, err := limiter.Reserve(ctx, "fresh@example.com", "10.0.0.9")
+	require.NoError(t, err)
+	assert.Nil(t, attempt)
+	assert.Greater(t, wait, time.Duration(0))
+
+	// The blocked attempt is not held against the account
+	attempts, _ := limiter.store.Get(ctx, "email:fresh@example.com")
+	assert.Zero(t, attempts.Failures)
+}
+
+func TestLoginLimiter_ConcurrentAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newLoginLimiter(newMemoryAttemptStore())
+	limiter.now = func() time.Time { return now }
+
+	// Guesses sent at once cannot all pass on the same history
+	var wg sync.WaitGroup
+	var passed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, _, err := limiter.Reserve(ctx, "ada@example.com", "10.0.0.1")
+			assert.NoError(t, err)
+			if attempt != nil {
+				passed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(emailLimitPolicy.FreeAttempts+1), passed.Load())
+}
+
+func TestLoginLimiter_Release(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limiter := newLoginLimiter(newMemoryAttemptStore())
+	limiter.now = func() time.Time { return now }
+
+	first, _, err := limiter.Reserve(ctx, "ada@example.com", "10.0.0.1")
+	require.NoError(t, err)
+	before, _ := limiter.store.Get(ctx, "email:ada@example.com")
+
+	// A released attempt leaves the history as it was
+	now = now.Add(time.Minute)
+	second, _, err := limiter.Reserve(ctx, "ada@example.com", "10.0.0.1")
+	require.NoError(t, err)
+	require.NoError(t, second.Release(ctx))
+	after, _ := limiter.store.Get(ctx, "email:ada@example.com")
+	assert.Equal(t, before, after)
+
+	// The first attempt is still counted
+	require.NotNil(t, first)
+	assert.Equal(t, 1, after.Failures)
+}
+
+func TestAttempts_WindowRestartsCount(t *testing.T) {
+	now := time.Now()
+
+	attempts := Attempts{}.withFailure(now, time.Hour).withFailure(now.Add(time.Minute), time.Hour)
+	assert.Equal(t, 2, attempts.Failures)
+
+	attempts = attempts.withFailure(now.Add(2*time.Hour), time.Hour)
+	assert.Equal(t, 1, attempts.Failures)
+}
+
+func TestPostgresAttemptStore(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer sqlDB.Close()
+	store := newPostgresAttemptStore(sqlDB)
+	ctx := context.Background()
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO login_attempts .* ON CONFLICT \\(key\\) DO NOTHING").
+		WithArgs("email:ada@example.com", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT failures, last_failure_at FROM login_attempts WHERE key = \\$1 FOR UPDATE").
+		WithArgs("email:ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at"}).AddRow(3, earlier))
+	mock.ExpectExec("UPDATE login_attempts SET failures = \\$2, last_failure_at = \\$3 WHERE key = \\$1").
+		WithArgs("email:ada@example.com", 4, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	wait, prev, err := store.Reserve(ctx, "email:ada@example.com", now, emailLimitPolicy)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+	assert.Equal(t, Attempts{Failures: 3, LastFailure: earlier}, prev)
+
+	// A key that must wait is not counted
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO login_attempts").
+		WithArgs("email:ada@example.com", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT failures, last_failure_at FROM login_attempts").
+		WithArgs("email:ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at"}).AddRow(emailLimitPolicy.LockoutThreshold, now))
+	mock.ExpectCommit()
+	wait, _, err = store.Reserve(ctx, "email:ada@example.com", now, emailLimitPolicy)
+	require.NoError(t, err)
+	assert.Equal(t, emailLimitPolicy.LockoutDuration, wait)
+
+	mock.ExpectExec("UPDATE login_attempts SET failures = GREATEST\\(failures - 1, 0\\)").
+		WithArgs("email:ada@example.com", now, earlier).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, store.Release(ctx, "email:ada@example.com", now, prev))
+
+	mock.ExpectQuery("SELECT failures, last_failure_at FROM login_attempts").
+		WithArgs("email:new@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at"}))
+	attempts, err := store.Get(ctx, "email:new@example.com")
+	require.NoError(t, err)
+	assert.Zero(t, attempts.Failures)
+
+	mock.ExpectExec("DELETE FROM login_attempts").
+		WithArgs("email:ada@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, store.Reset(ctx, "email:ada@example.com"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLogin_TooManyAttempts(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/login", login)
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	attempt := func(password string) *http.Response {
+		req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"ada@example.com","password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	for i := 0; i < emailLimitPolicy.FreeAttempts+1; i++ {
+		mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+			WithArgs("ada@example.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "totp_enabled", "disabled"}).AddRow("user-1", string(hashed), false, false))
+		mock.ExpectExec("INSERT INTO login_audit").
+			WithArgs("ada@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "invalid_password").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		assert.Equal(t, http.StatusUnauthorized, attempt("wrong guess").StatusCode)
+	}
+
+	// Even the right password waits out the backoff without a user lookup
+	mock.ExpectExec("INSERT INTO login_audit").
+		WithArgs("ada@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "rate_limited").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	resp := attempt("correct horse")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
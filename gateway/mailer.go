@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers account emails such as verification and password reset
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var mailer Mailer = &logMailer{}
+
+// loadMailer selects the mailer from MAILER, smtp or log. The SMTP mailer
+// reads SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM;
+// the log mailer writes to MAIL_DIR when set. There is no default: the log
+// mailer records live reset tokens, so it has to be asked for.
+func loadMailer() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "":
+		return nil, errors.New("MAILER must be set to smtp or log")
+	case "log":
+		return &logMailer{dir: os.Getenv("MAIL_DIR")}, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		from := os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			return nil, fmt.Errorf("SMTP_HOST and MAIL_FROM must be set for the smtp mailer")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &smtpMailer{
+			host:     host,
+			addr:     net.JoinHostPort(host, port),
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+// smtpMailer sends through an SMTP relay, using STARTTLS when offered
+type smtpMailer struct {
+	host     string
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	if err := smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, formatMessage(m.from, msg)); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// logMailer is for tests and local development: messages are logged, or
+// written as .eml files when a directory is configured
+type logMailer struct {
+	dir   string
+	count atomic.Int64
+}
+
+func (m *logMailer) Send(ctx context.Context, msg Message) error {
+	if m.dir == "" {
+		log.Printf("[INFO] Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	name := fmt.Sprintf("%d-%03d.eml", time.Now().UnixNano(), m.count.Add(1))
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, formatMessage("neuronote@localhost", msg), 0600); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	log.Printf("[INFO] Mail to %s written to %s", msg.To, path)
+	return nil
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
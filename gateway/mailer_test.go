@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMailer(t *testing.T) {
+	// Without MAILER reset links must not end up in the logs unasked
+	t.Setenv("MAILER", "")
+	_, err := loadMailer()
+	assert.Error(t, err)
+
+	t.Setenv("MAILER", "log")
+	t.Setenv("MAIL_DIR", "/tmp/mail")
+	m, err := loadMailer()
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/mail", m.(*logMailer).dir)
+
+	t.Setenv("MAILER", "smtp")
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("MAIL_FROM", "")
+	_, err = loadMailer()
+	assert.Error(t, err)
+
+	t.Setenv("MAIL_FROM", "noreply@example.com")
+	m, err = loadMailer()
+	assert.NoError(t, err)
+	assert.Equal(t, "smtp.example.com:587", m.(*smtpMailer).addr)
+
+	t.Setenv("MAILER", "carrier-pigeon")
+	_, err = loadMailer()
+	assert.Error(t, err)
+}
+
+func TestLogMailer_WritesMessages(t *testing.T) {
+	dir := t.TempDir()
+	m := &logMailer{dir: dir}
+
+	for i := 0; i < 2; i++ {
+		err := m.Send(context.Background(), Message{To: "ada@example.com", Subject: "Hello", Body: "line one\nline two\n"})
+		assert.NoError(t, err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	data, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"From: neuronote@localhost\r\nTo: ada@example.com\r\nSubject: Hello\r\n"+
+			"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n"+
+			"line one\r\nline two\r\n",
+		string(data),
+	)
+}
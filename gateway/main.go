@@ -1,36 +1,33 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
-	"mime/multipart"
-	"net/http"
 	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 )
 
-// Database connection string
-const (
-	mlBaseURL = "http://ml:8000"
-)
-
 // Response models
 type Note struct {
-	ID        string     `json:"id"`
-	Title     string     `json:"title"`
-	Content   string     `json:"content"`
-	Summary   string     `json:"summary"`
-	QuizCards []QuizCard `json:"quiz_cards"`
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
+	ID         string    `json:"id"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content,omitempty"` // left out of lists unless requested
+	Summary    string    `json:"summary"`
+	QuizCards  QuizCards `json:"quiz_cards"`
+	Tags       []string  `json:"tags"`
+	NotebookID *string   `json:"notebook_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type QuizCard struct {
@@ -40,6 +37,30 @@ type QuizCard struct {
 	Answer   string `json:"answer"`
 }
 
+// QuizCards scans the json_agg of a note's quiz cards
+type QuizCards []QuizCard
+
+func (q *QuizCards) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*q = QuizCards{}
+		return nil
+	default:
+		return fmt.Errorf("unsupported quiz_cards type %T", src)
+	}
+	cards := QuizCards{}
+	if err := json.Unmarshal(data, &cards); err != nil {
+		return err
+	}
+	*q = cards
+	return nil
+}
+
 type StudyBlock struct {
 	ID        string    `json:"id"`
 	StartTime time.Time `json:"start_time"`
@@ -57,49 +78,9 @@ func healthCheck(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"ok": true})
 }
 
-func getNotes(c *fiber.Ctx) error {
-	// Get user ID from context
-	userID := c.Get("X-User-ID")
-
-	// Query notes from database
-	rows, err := db.Query(`
-		SELECT n.id, n.title, n.content, n.summary, n.created_at, n.updated_at,
-			   array_agg(json_build_object(
-				   'id', q.id,
-				   'question', q.question,
-				   'answer', q.answer
-			   )) as quiz_cards
-		FROM notes n
-		LEFT JOIN quiz_cards q ON n.id = q.note_id
-		WHERE n.user_id = $1
-		GROUP BY n.id
-		ORDER BY n.created_at DESC
-	`, userID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch notes",
-		})
-	}
-	defer rows.Close()
-
-	var notes []Note
-	for rows.Next() {
-		var note Note
-		err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.Summary, &note.CreatedAt, &note.UpdatedAt, &note.QuizCards)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to scan note",
-			})
-		}
-		notes = append(notes, note)
-	}
-
-	return c.JSON(notes)
-}
-
 func getStudyBlocks(c *fiber.Ctx) error {
-	// Get user ID from context
-	userID := c.Get("X-User-ID")
+	// Get user ID from session
+	userID := currentUserID(c)
 
 	// Query study blocks from database
 	rows, err := db.Query(`
@@ -130,132 +111,156 @@ func getStudyBlocks(c *fiber.Ctx) error {
 	return c.JSON(blocks)
 }
 
+// uploadNote stages the file and queues it for the ML service. The note is
+// created by a job worker; poll GET /api/jobs/:id or follow
+// GET /api/jobs/:id/events for it. The file is written to disk as it
+// arrives rather than buffered.
 func uploadNote(c *fiber.Ctx) error {
-	// Parse the uploaded file
-	fileHeader, err := c.FormFile("file")
-	if err != nil {
+	if int64(c.Request().Header.ContentLength()) > maxUploadBytes {
+		return uploadTooLarge(c)
+	}
+
+	// Get user ID from session
+	userID := currentUserID(c)
+
+	// Stage the file where it will stay as the note's original
+	jobID := uuid.New().String()
+	path := uploadPath(userID, jobID)
+	upload, err := stageUpload(c, path)
+	if errors.Is(err, errUploadTooLarge) {
+		return uploadTooLarge(c)
+	}
+	if errors.Is(err, errNoUploadFile) {
 		log.Printf("[ERROR] No file uploaded: %v", err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "No file uploaded",
 		})
 	}
-
-	log.Printf("[INFO] Received file: %s (%d bytes, header type: %s)", fileHeader.Filename, fileHeader.Size, fileHeader.Header.Get("Content-Type"))
-
-	// Open the file
-	file, err := fileHeader.Open()
 	if err != nil {
-		log.Printf("[ERROR] Failed to open file: %v", err)
+		log.Printf("[ERROR] Failed to stage upload: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to open file",
+			"error": "Failed to store upload",
 		})
 	}
-	defer file.Close()
-
-	// Read the file into a buffer (for forwarding or processing)
-	var buf bytes.Buffer
-	size, err := io.Copy(&buf, file)
-	if err != nil || size == 0 {
-		log.Printf("[ERROR] File is empty or could not be read: %v", err)
+	if upload.SizeBytes == 0 {
+		os.Remove(path)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "File is empty or could not be read",
 		})
 	}
-	log.Printf("[INFO] File read into buffer: %d bytes", size)
 
-	// Get user ID from context
-	userID := c.Get("X-User-ID")
-	if userID == "" {
-		userID = "anonymous" // Fallback for testing
-	}
-	log.Printf("[INFO] User ID: %s", userID)
+	log.Printf("[INFO] Received file: %s (%d bytes, header type: %s)", upload.Filename, upload.SizeBytes, upload.ContentType)
 
-	// Forward to ML service as multipart/form-data
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", fileHeader.Filename)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create form file for ML service: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create form file for ML service",
-		})
-	}
-	if _, err = io.Copy(part, bytes.NewReader(buf.Bytes())); err != nil {
-		log.Printf("[ERROR] Failed to copy file data to ML service: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to copy file data to ML service",
-		})
-	}
-	if err = writer.WriteField("user_id", userID); err != nil {
-		log.Printf("[ERROR] Failed to add user ID to ML service: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add user ID to ML service",
-		})
+	// Check the notebook before anything is queued
+	notebookID := upload.Fields["notebook_id"]
+	if notebookID != "" {
+		owned, err := ownsNotebook(userID, notebookID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to check notebook: %v", err)
+			os.Remove(path)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get notebook",
+			})
+		}
+		if !owned {
+			os.Remove(path)
+			return validationError(c, FieldErrors{"notebook_id": "Notebook not found"})
+		}
 	}
-	writer.Close()
 
-	mlReq, err := http.NewRequest("POST", mlBaseURL+"/pipeline", body)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create ML request: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create ML request",
-		})
+	contentType := upload.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
-	mlReq.Header.Set("Content-Type", writer.FormDataContentType())
-
-	log.Printf("[INFO] Sending file to ML service at %s/pipeline", mlBaseURL)
-	mlResp, err := http.DefaultClient.Do(mlReq)
+	job, err := enqueueJob(db, jobID, userID, notebookID, upload.Filename, contentType, upload.SizeBytes)
 	if err != nil {
-		log.Printf("[ERROR] ML service error: %v", err)
+		log.Printf("[ERROR] Failed to queue upload: %v", err)
+		os.Remove(path)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "ML service error: " + err.Error(),
+			"error": "Failed to queue upload",
 		})
 	}
-	defer mlResp.Body.Close()
+	wakeJobWorker()
+	log.Printf("[INFO] Queued upload %s as job %s", upload.Filename, job.ID)
 
-	if mlResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(mlResp.Body)
-		log.Printf("[ERROR] ML service returned status %d: %s", mlResp.StatusCode, string(body))
-		return c.Status(mlResp.StatusCode).JSON(fiber.Map{
-			"error": "ML service error: " + string(body),
-		})
-	}
-
-	// Parse ML service response
-	var mlResult struct {
-		NoteID string `json:"note_id"`
-	}
-	if err := json.NewDecoder(mlResp.Body).Decode(&mlResult); err != nil {
-		log.Printf("[ERROR] Failed to parse ML response: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to parse ML response: " + err.Error(),
-		})
-	}
-	log.Printf("[INFO] ML service returned note_id: %s", mlResult.NoteID)
-
-	// Return the created note
-	var note Note
-	err = db.QueryRow(`
-		SELECT n.id, n.title, n.content, n.summary, n.created_at, n.updated_at,
-			   array_agg(json_build_object(
-				   'id', q.id,
-				   'question', q.question,
-				   'answer', q.answer
-			   )) as quiz_cards
-		FROM notes n
-		LEFT JOIN quiz_cards q ON n.id = q.note_id
-		WHERE n.id = $1
-		GROUP BY n.id
-	`, mlResult.NoteID).Scan(&note.ID, &note.Title, &note.Content, &note.Summary, &note.CreatedAt, &note.UpdatedAt, &note.QuizCards)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch created note: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch created note",
-		})
-	}
-	log.Printf("[INFO] Successfully uploaded and processed note: %s", note.ID)
+	c.Location("/api/jobs/" + job.ID)
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
 
-	return c.JSON(note)
+func setupRoutes(app *fiber.App) {
+	app.Use(limitBody)
+	app.Get("/health", healthCheck)
+	app.Get("/.well-known/jwks.json", getJWKS)
+	app.Post("/auth/signup", signup)
+	app.Post("/auth/login", login)
+	app.Post("/auth/refresh", refresh)
+	app.Post("/auth/password/forgot", forgotPassword)
+	app.Post("/auth/password/reset", resetPassword)
+	app.Post("/auth/verify", verifyEmail)
+	app.Post("/auth/2fa/verify", verifyTwoFactor)
+	app.Get("/auth/oidc/:provider/start", oidcStart)
+	app.Get("/auth/oidc/:provider/callback", oidcCallback)
+
+	// Session management
+	app.Post("/auth/logout", authMiddleware(), requireSession(), logout)
+	app.Get("/auth/sessions", authMiddleware(), requireSession(), listSessions)
+	app.Delete("/auth/sessions", authMiddleware(), requireSession(), revokeAllSessions)
+	app.Delete("/auth/sessions/:id", authMiddleware(), requireSession(), revokeSession)
+
+	// Two-factor enrolment
+	app.Post("/auth/2fa/setup", authMiddleware(), requireSession(), setupTwoFactor)
+	app.Post("/auth/2fa/confirm", authMiddleware(), requireSession(), confirmTwoFactor)
+
+	// API keys for scripts
+	app.Post("/auth/api-keys", authMiddleware(), requireSession(), createAPIKey)
+	app.Get("/auth/api-keys", authMiddleware(), requireSession(), listAPIKeys)
+	app.Delete("/auth/api-keys/:id", authMiddleware(), requireSession(), revokeAPIKey)
+
+	// Leaving
+	app.Delete("/auth/account", authMiddleware(), requireSession(), deleteAccount)
+
+	// Administration
+	admin := app.Group("/admin", authMiddleware(), requireSession(), requireRole(roleAdmin))
+	admin.Get("/users", adminListUsers)
+	admin.Get("/users/:id", adminGetUser)
+	admin.Post("/users/:id/disable", adminDisableUser)
+	admin.Post("/users/:id/enable", adminEnableUser)
+	admin.Delete("/users/:id/sessions", adminRevokeSessions)
+
+	// Protected routes, the user is taken from the verified session or API key
+	api := app.Group("/api", authMiddleware())
+	api.Get("/notes", requireScope(scopeNotesRead), getNotes)
+	api.Post("/notes", requireScope(scopeNotesWrite), uploadNote)
+	api.Post("/notes/upload", requireScope(scopeNotesWrite), uploadNote)
+	api.Post("/uploads", requireScope(scopeNotesWrite), createUpload)
+	api.Head("/uploads/:id", requireScope(scopeNotesWrite), headUpload)
+	api.Patch("/uploads/:id", requireScope(scopeNotesWrite), patchUpload)
+	api.Post("/uploads/:id/complete", requireScope(scopeNotesWrite), completeUpload)
+	api.Delete("/uploads/:id", requireScope(scopeNotesWrite), deleteUpload)
+	api.Get("/notes/:id", requireScope(scopeNotesRead), getNote)
+	api.Patch("/notes/:id", requireScope(scopeNotesWrite), updateNote)
+	api.Delete("/notes/:id", requireScope(scopeNotesWrite), deleteNote)
+	api.Get("/notes/:id/revisions", requireScope(scopeNotesRead), listNoteRevisions)
+	api.Get("/notes/:id/revisions/diff", requireScope(scopeNotesRead), diffNoteRevisions)
+	api.Get("/notes/:id/revisions/:rev", requireScope(scopeNotesRead), getNoteRevision)
+	api.Post("/notes/:id/revisions/:rev/restore", requireScope(scopeNotesWrite), restoreNoteRevision)
+	api.Post("/notes/:id/tags", requireScope(scopeNotesWrite), addNoteTags)
+	api.Delete("/notes/:id/tags/:tag", requireScope(scopeNotesWrite), removeNoteTag)
+	api.Get("/tags", requireScope(scopeNotesRead), listTags)
+	api.Patch("/tags/:tag", requireScope(scopeNotesWrite), renameTag)
+	api.Get("/notebooks", requireScope(scopeNotesRead), listNotebooks)
+	api.Post("/notebooks", requireScope(scopeNotesWrite), createNotebook)
+	api.Get("/notebooks/:id", requireScope(scopeNotesRead), getNotebook)
+	api.Patch("/notebooks/:id", requireScope(scopeNotesWrite), updateNotebook)
+	api.Delete("/notebooks/:id", requireScope(scopeNotesWrite), deleteNotebook)
+	api.Get("/notebooks/:id/notes", requireScope(scopeNotesRead), getNotebookNotes)
+	api.Get("/jobs/:id", requireScope(scopeNotesRead), getJob)
+	api.Get("/jobs/:id/events", requireScope(scopeNotesRead), streamJobEvents)
+	api.Get("/search", requireScope(scopeNotesRead), searchNotes)
+	api.Get("/study-blocks", requireScope(scopeScheduleRead), getStudyBlocks)
+	api.Get("/schedule", requireScope(scopeScheduleRead), getStudySchedule)
+	api.Post("/schedule", requireScope(scopeScheduleWrite), createSchedule)
+	api.Get("/export", requireSession(), exportData)
 }
 
 func main() {
@@ -272,25 +277,76 @@ func main() {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
-	// Create Fiber app
-	app := fiber.New()
+	// Load JWT signing keys
+	signingKeys, err = loadKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
+	// Keep original uploads on disk
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		uploadDir = dir
+	}
+
+	// Load password policy
+	passwordPolicy, err = loadPasswordPolicy()
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+
+	// Configure account email delivery
+	mailer, err = loadMailer()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+
+	// Configure single sign-on providers
+	oidcProviders, err = loadOIDCProviders()
+	if err != nil {
+		log.Fatalf("Failed to configure OIDC providers: %v", err)
+	}
+
+	// Share login attempts between instances
+	loginLimiter = newLoginLimiter(newPostgresAttemptStore(db))
+
+	// Cap upload size
+	maxUploadBytes, err = loadMaxUploadBytes()
+	if err != nil {
+		log.Fatalf("Failed to configure upload limit: %v", err)
+	}
+
+	// Process queued uploads
+	jobWorkers, err := loadJobWorkers()
+	if err != nil {
+		log.Fatalf("Failed to configure job workers: %v", err)
+	}
+	mlClient, err = loadMLClient()
+	if err != nil {
+		log.Fatalf("Failed to configure ML client: %v", err)
+	}
+	startJobWorkers(context.Background(), jobWorkers)
+	go sweepExpiredUploads(context.Background())
+
+	// Create Fiber app. Large bodies are streamed so uploads go straight
+	// to disk; limitBody keeps the other routes to requestBodyLimit.
+	app := fiber.New(fiber.Config{
+		BodyLimit:                    requestBodyLimit,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
 
 	// Add middleware
 	app.Use(logger.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:5173",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-User-ID",
-		AllowMethods:     "GET, POST, PUT, DELETE, OPTIONS",
-		ExposeHeaders:    "Content-Length, Content-Type",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Upload-Offset",
+		AllowMethods:     "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders:    "Content-Length, Content-Type, Location, X-Total-Count, X-Next-Cursor, Upload-Offset, Upload-Length",
 		AllowCredentials: true,
 	}))
 
 	// Routes
-	app.Get("/health", healthCheck)
-	app.Get("/notes", getNotes)
-	app.Get("/study-blocks", getStudyBlocks)
-	app.Post("/notes", uploadNote)
-	app.Post("/notes/upload", uploadNote)
+	setupRoutes(app)
 
 	// Start server
 	log.Fatal(app.Listen(":8080"))
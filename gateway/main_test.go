@@ -6,6 +6,8 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -15,10 +17,6 @@ import (
 )
 
 func setupTestApp() (*fiber.App, sqlmock.Sqlmock) {
-	// Initialize ML client
-	mlClient = NewMLClient()
-	mlClient.baseURL = "http://localhost:8000" // Use local URL for testing
-
 	// Create mock database
 	var err error
 	var mock sqlmock.Sqlmock
@@ -27,11 +25,28 @@ func setupTestApp() (*fiber.App, sqlmock.Sqlmock) {
 		panic(err)
 	}
 
+	// Start every test without failed logins
+	loginLimiter = newLoginLimiter(newMemoryAttemptStore())
+
+	// Sign test tokens with a fixed HS256 key
+	signingKeys = newKeyring(newHMACKey("test-secret-test-secret-test-secret"))
+
+	// Log mail instead of sending it
+	mailer = &logMailer{}
+
 	// Create Fiber app
 	app := fiber.New()
 	return app, mock
 }
 
+// withUser stands in for authMiddleware in handler tests
+func withUser(userID string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user_id", userID)
+		return c.Next()
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	app, _ := setupTestApp()
 	app.Get("/health", healthCheck)
@@ -49,12 +64,15 @@ func TestHealthCheck(t *testing.T) {
 
 func TestUploadNote(t *testing.T) {
 	app, mock := setupTestApp()
-	app.Post("/api/notes", uploadNote)
+	app.Post("/api/notes", withUser("test-user-id"), uploadNote)
+	uploadDir = t.TempDir()
 
-	// Mock the database insert
-	mock.ExpectQuery(`INSERT INTO notes`).
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("test-note-id"))
+	// The upload is queued, the ML service is not called in the request
+	now := time.Now()
+	mock.ExpectQuery(`INSERT INTO jobs`).
+		WithArgs(sqlmock.AnyArg(), "test-user-id", nil, "test.txt", "application/octet-stream", 28).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow("test-job-id", "queued", "", "", "", "test.txt", "application/octet-stream", 28, now, nil, nil))
 
 	// Create a test file
 	body := &bytes.Buffer{}
@@ -67,38 +85,52 @@ func TestUploadNote(t *testing.T) {
 	assert.NoError(t, err)
 	writer.Close()
 
-	// Create a test request
+	// Create a test request, the header must not override the session user
 	req := httptest.NewRequest("POST", "/api/notes", body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("X-User-ID", "test-user-id")
+	req.Header.Set("X-User-ID", "spoofed-user-id")
 
 	// Test the endpoint
 	resp, err := app.Test(req)
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "/api/jobs/test-job-id", resp.Header.Get("Location"))
 
 	// Parse response
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	var job Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
 	assert.NoError(t, err)
-	assert.Contains(t, result, "id")
+	assert.Equal(t, "queued", job.Status)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// The file is staged for the worker
+	stored, err := os.ReadDir(filepath.Join(uploadDir, "test-user-id"))
+	assert.NoError(t, err)
+	if assert.Len(t, stored, 1) {
+		data, err := os.ReadFile(filepath.Join(uploadDir, "test-user-id", stored[0].Name()))
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+	}
 }
 
 func TestGetNotes(t *testing.T) {
 	app, mock := setupTestApp()
-	app.Get("/api/notes", getNotes)
+	app.Get("/api/notes", withUser("test-user-id"), getNotes)
 
 	// Mock the database query
-	rows := sqlmock.NewRows([]string{"id", "title", "content", "summary", "created_at", "updated_at", "quiz_cards"}).
-		AddRow("test-id", "Test Note", "content", "summary", time.Now(), time.Now(), "[]")
+	rows := sqlmock.NewRows([]string{"id", "title", "content", "summary", "created_at", "updated_at", "quiz_cards", "tags", "notebook_id"}).
+		AddRow("test-id", "Test Note", "content", "summary", time.Now(), time.Now(), "[]", "{biology}", nil)
 
-	mock.ExpectQuery(`SELECT n.id, n.title, n.content, n.summary, n.created_at, n.updated_at`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM notes n WHERE n.user_id = \$1`).
 		WithArgs("test-user-id").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT n.id, COALESCE\(n.title, ''\), '', n.summary, n.created_at, n.updated_at`).
+		WithArgs("test-user-id", defaultNotePageSize+1).
 		WillReturnRows(rows)
 
 	// Create a test request
 	req := httptest.NewRequest("GET", "/api/notes", nil)
-	req.Header.Set("X-User-ID", "test-user-id")
+	req.Header.Set("X-User-ID", "spoofed-user-id")
 
 	// Test the endpoint
 	resp, err := app.Test(req)
@@ -111,16 +143,17 @@ func TestGetNotes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, notes, 1)
 	assert.Equal(t, "test-id", notes[0].ID)
+	assert.Empty(t, notes[0].QuizCards)
 }
 
 func TestGetStudyBlocks(t *testing.T) {
 	app, mock := setupTestApp()
-	app.Get("/api/schedule", getStudyBlocks)
+	app.Get("/api/schedule", withUser("test-user-id"), getStudyBlocks)
 
 	// Mock the database query
 	now := time.Now()
-	rows := sqlmock.NewRows([]string{"id", "note_id", "start_time", "end_time", "status"}).
-		AddRow("block-1", "note-1", now, now.Add(time.Hour), "scheduled")
+	rows := sqlmock.NewRows([]string{"id", "start_time", "end_time", "note_id", "status"}).
+		AddRow("block-1", now, now.Add(time.Hour), "note-1", "scheduled")
 
 	mock.ExpectQuery(`SELECT id, start_time, end_time, note_id, status FROM study_blocks`).
 		WithArgs("test-user-id").
@@ -128,7 +161,7 @@ func TestGetStudyBlocks(t *testing.T) {
 
 	// Create a test request
 	req := httptest.NewRequest("GET", "/api/schedule", nil)
-	req.Header.Set("X-User-ID", "test-user-id")
+	req.Header.Set("X-User-ID", "spoofed-user-id")
 
 	// Test the endpoint
 	resp, err := app.Test(req)
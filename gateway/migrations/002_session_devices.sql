@@ -0,0 +1,4 @@
+-- Record a device hint for each session so users can tell them apart
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT;
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
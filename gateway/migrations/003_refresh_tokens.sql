@@ -0,0 +1,15 @@
+-- Short-lived access tokens with rotating refresh tokens. Each row is one
+-- rotation step; rows sharing a family_id descend from the same login.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS refresh_token_hash TEXT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS family_id UUID;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMPTZ;
+
+-- Sessions issued before refresh tokens hold 30-day tokens that are no
+-- longer accepted, so they are dropped rather than converted
+DELETE FROM sessions WHERE refresh_token_hash IS NULL;
+
+ALTER TABLE sessions ALTER COLUMN refresh_token_hash SET NOT NULL;
+ALTER TABLE sessions ALTER COLUMN family_id SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS sessions_refresh_token_hash_idx ON sessions(refresh_token_hash);
+CREATE INDEX IF NOT EXISTS sessions_family_id_idx ON sessions(family_id);
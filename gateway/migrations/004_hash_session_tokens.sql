@@ -0,0 +1,12 @@
+-- Store SHA-256 digests of access tokens instead of the tokens themselves.
+-- Rows still holding a raw JWT are converted in place; a hex digest is
+-- always 64 characters, which no JWT is.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+UPDATE sessions
+SET token = encode(digest(token, 'sha256'), 'hex')
+WHERE length(token) <> 64;
+
+ALTER TABLE sessions RENAME COLUMN token TO token_hash;
+
+CREATE UNIQUE INDEX IF NOT EXISTS sessions_token_hash_idx ON sessions(token_hash);
@@ -0,0 +1,10 @@
+-- Emails are trimmed and case-folded on signup and login. Fold existing
+-- rows too, leaving any that would collide with another account for
+-- manual review.
+UPDATE users u
+SET email = lower(trim(u.email))
+WHERE u.email <> lower(trim(u.email))
+  AND NOT EXISTS (
+      SELECT 1 FROM users o
+      WHERE o.id <> u.id AND lower(trim(o.email)) = lower(trim(u.email))
+  );
@@ -0,0 +1,20 @@
+-- Failed login attempts per key ("email:<address>" or "ip:<address>"),
+-- shared by every gateway instance
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL
+);
+
+-- Audit trail of failed and rate-limited logins
+CREATE TABLE IF NOT EXISTS login_audit (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    user_agent TEXT,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_audit_email_idx ON login_audit(email, created_at);
+CREATE INDEX IF NOT EXISTS login_audit_ip_address_idx ON login_audit(ip_address, created_at);
@@ -0,0 +1,16 @@
+-- Single-use tokens for password reset and email verification links.
+-- Only the SHA-256 digest of a token is stored.
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_tokens_token_hash_idx ON user_tokens(token_hash);
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens(user_id, purpose);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
@@ -0,0 +1,13 @@
+-- Accounts at external OpenID Connect providers, keyed by the provider's
+-- stable subject identifier. Users created through single sign-on have
+-- an empty hashed_password, which never matches at password login.
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
@@ -0,0 +1,14 @@
+-- Original files behind uploaded notes, kept on disk under UPLOAD_DIR so
+-- they can be included in data exports. Rows go with their note.
+CREATE TABLE IF NOT EXISTS note_files (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    note_id UUID NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS note_files_note_id_idx ON note_files(note_id);
+CREATE INDEX IF NOT EXISTS note_files_user_id_idx ON note_files(user_id);
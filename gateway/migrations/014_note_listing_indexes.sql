@@ -0,0 +1,9 @@
+-- Keyset pagination of a user's notes for each sort order, and lookups
+-- behind the tag and source type filters
+CREATE INDEX IF NOT EXISTS notes_user_id_created_at_idx ON notes(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_id_updated_at_idx ON notes(user_id, updated_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_id_title_idx ON notes(user_id, title, id);
+
+CREATE INDEX IF NOT EXISTS tags_note_id_idx ON tags(note_id);
+CREATE INDEX IF NOT EXISTS ocr_blocks_note_id_idx ON ocr_blocks(note_id);
+CREATE INDEX IF NOT EXISTS audio_notes_note_id_idx ON audio_notes(note_id);
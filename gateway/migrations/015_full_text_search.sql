@@ -0,0 +1,21 @@
+-- Full-text search over notes, quiz cards and OCR text. The vectors are
+-- generated columns, so they follow every insert and update.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(summary, '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(content, '')), 'C')
+    ) STORED;
+
+ALTER TABLE quiz_cards ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(question, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(answer, '')), 'B')
+    ) STORED;
+
+ALTER TABLE ocr_blocks ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', coalesce(text, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS notes_search_vector_idx ON notes USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS quiz_cards_search_vector_idx ON quiz_cards USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS ocr_blocks_search_vector_idx ON ocr_blocks USING GIN (search_vector);
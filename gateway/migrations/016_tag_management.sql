@@ -0,0 +1,12 @@
+-- Tags are stored normalised (trimmed, single-spaced, lower case) and once
+-- per note, so they can be counted, renamed and merged per user
+UPDATE tags SET tag = lower(btrim(regexp_replace(tag, '\s+', ' ', 'g')));
+DELETE FROM tags WHERE note_id IS NULL OR tag IS NULL OR tag = '';
+DELETE FROM tags a USING tags b
+    WHERE a.note_id = b.note_id AND a.tag = b.tag AND a.id > b.id;
+
+ALTER TABLE tags ALTER COLUMN note_id SET NOT NULL;
+ALTER TABLE tags ALTER COLUMN tag SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS tags_note_id_tag_idx ON tags(note_id, tag);
+CREATE INDEX IF NOT EXISTS tags_tag_idx ON tags(tag);
@@ -0,0 +1,23 @@
+-- Notebooks group a user's notes by course. A notebook's exam date is the
+-- default due date when its notes are scheduled. Deleting a notebook keeps
+-- its notes, they become unassigned.
+CREATE TABLE IF NOT EXISTS notebooks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    exam_date TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS notebooks_user_id_name_idx ON notebooks(user_id, lower(name));
+
+DROP TRIGGER IF EXISTS update_notebooks_updated_at ON notebooks;
+CREATE TRIGGER update_notebooks_updated_at
+    BEFORE UPDATE ON notebooks
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS notes_notebook_id_idx ON notes(notebook_id);
@@ -0,0 +1,62 @@
+-- Every title, content or summary a note has had, numbered per note. The
+-- first revision is the note as the ML pipeline created it. Rows are only
+-- ever added; they go when their note is deleted.
+CREATE TABLE IF NOT EXISTS note_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    note_id UUID NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    title TEXT,
+    content TEXT,
+    summary TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (note_id, revision)
+);
+
+CREATE OR REPLACE FUNCTION record_note_revision()
+RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO note_revisions (note_id, revision, title, content, summary)
+    VALUES (
+        NEW.id,
+        COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = NEW.id), 0) + 1,
+        NEW.title,
+        NEW.content,
+        NEW.summary
+    );
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS record_note_revision_insert ON notes;
+CREATE TRIGGER record_note_revision_insert
+    AFTER INSERT ON notes
+    FOR EACH ROW
+    EXECUTE FUNCTION record_note_revision();
+
+DROP TRIGGER IF EXISTS record_note_revision_update ON notes;
+CREATE TRIGGER record_note_revision_update
+    AFTER UPDATE OF title, content, summary ON notes
+    FOR EACH ROW
+    WHEN (OLD.title IS DISTINCT FROM NEW.title
+        OR OLD.content IS DISTINCT FROM NEW.content
+        OR OLD.summary IS DISTINCT FROM NEW.summary)
+    EXECUTE FUNCTION record_note_revision();
+
+CREATE OR REPLACE FUNCTION forbid_note_revision_update()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'note_revisions is append-only';
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS note_revisions_append_only ON note_revisions;
+CREATE TRIGGER note_revisions_append_only
+    BEFORE UPDATE ON note_revisions
+    FOR EACH ROW
+    EXECUTE FUNCTION forbid_note_revision_update();
+
+-- Notes from before this migration start their history here
+INSERT INTO note_revisions (note_id, revision, title, content, summary, created_at)
+SELECT n.id, 1, n.title, n.content, n.summary, COALESCE(n.updated_at, NOW())
+FROM notes n
+WHERE NOT EXISTS (SELECT 1 FROM note_revisions r WHERE r.note_id = n.id);
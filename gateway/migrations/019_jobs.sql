@@ -0,0 +1,25 @@
+-- Uploads waiting for or going through the ML service. The gateway's
+-- workers claim queued jobs with SKIP LOCKED, so several instances can
+-- share the table. A running job that has not moved within the lease is
+-- taken over by another worker. The staged file is the upload on disk
+-- named by the job id, which becomes the note_files id on success.
+CREATE TABLE IF NOT EXISTS jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL,
+    status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+    stage TEXT CHECK (stage IN ('ocr', 'asr', 'summarise', 'qa')),
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    note_id UUID REFERENCES notes(id) ON DELETE SET NULL,
+    error TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS jobs_user_id_idx ON jobs(user_id);
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs(created_at) WHERE status IN ('queued', 'running');
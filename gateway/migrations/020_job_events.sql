@@ -0,0 +1,12 @@
+-- Progress of upload jobs as it happened, replayed to event stream clients.
+-- The id is the SSE event id, so a reconnecting client resumes after the
+-- last event it saw, whichever gateway instance it reaches.
+CREATE TABLE IF NOT EXISTS job_events (
+    id BIGSERIAL PRIMARY KEY,
+    job_id UUID NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS job_events_job_id_idx ON job_events(job_id, id);
@@ -0,0 +1,18 @@
+-- Files being sent in chunks. The bytes received so far are staged on disk
+-- under the upload id and offset_bytes records how many of them are
+-- synced; a client resumes from there after a dropped connection. Once
+-- complete the row is replaced by a job with the same id.
+CREATE TABLE IF NOT EXISTS uploads (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL CHECK (size_bytes > 0),
+    offset_bytes BIGINT NOT NULL DEFAULT 0 CHECK (offset_bytes BETWEEN 0 AND size_bytes),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS uploads_user_id_idx ON uploads(user_id, expires_at);
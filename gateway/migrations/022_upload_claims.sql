@@ -0,0 +1,6 @@
+-- A chunk being written claims its upload until claimed_until instead of
+-- holding a row lock while the body streams in, so a lost request does not
+-- keep the upload busy. claim_token lets the request release only its own
+-- claim.
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS claim_token UUID;
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+-- Expired uploads are swept for every user at once
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads(expires_at);
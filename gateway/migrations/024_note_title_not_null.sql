@@ -0,0 +1,5 @@
+-- Untitled notes store an empty title, so the title sort and its cursor
+-- compare plain values and use notes_user_id_title_idx
+UPDATE notes SET title = '' WHERE title IS NULL;
+ALTER TABLE notes ALTER COLUMN title SET DEFAULT '';
+ALTER TABLE notes ALTER COLUMN title SET NOT NULL;
@@ -6,89 +6,102 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
-// MLClient handles communication with the ML service
-type MLClient struct {
+const (
+	defaultMLServiceURL = "http://ml:8000"
+	// ML tasks on long recordings run for minutes
+	defaultMLTimeout = 5 * time.Minute
+	mlDialTimeout    = 10 * time.Second
+	// The summarise stage makes two ML calls under one lease renewal
+	mlCallsPerStage = 2
+)
+
+// MLClient runs the ML service's stages. Workers use whichever client is
+// in mlClient, so tests can point it at a stand-in.
+type MLClient interface {
+	OCR(file io.Reader, filename string, userID string) ([]Block, error)
+	ASR(file io.Reader, filename string, userID string) (string, error)
+	Summarize(text string) (string, error)
+	GenerateQA(text string, maxQuestions int) ([]QAPair, error)
+	Keyphrases(text string, topN int) ([]string, error)
+}
+
+// httpMLClient talks to the ML service over HTTP
+type httpMLClient struct {
 	baseURL    string
 	httpClient *http.Client
 }
 
-// NewMLClient creates a new ML service client
-func NewMLClient() *MLClient {
-	return &MLClient{
-		baseURL: mlBaseURL,
+// newHTTPMLClient creates a client for the ML service at baseURL. Each request,
+// including sending the upload, must finish within timeout.
+func newHTTPMLClient(baseURL string, timeout time.Duration) *httpMLClient {
+	return &httpMLClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
 		httpClient: &http.Client{
-			Timeout: time.Second * 300, // 5 minutes timeout for long-running ML tasks
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: mlDialTimeout}).DialContext,
+				TLSHandshakeTimeout:   mlDialTimeout,
+				MaxIdleConnsPerHost:   defaultJobWorkers,
+				IdleConnTimeout:       90 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
 		},
 	}
 }
 
-// Pipeline processes a file through the ML pipeline
-func (c *MLClient) Pipeline(file io.Reader, filename string, userID string) (string, error) {
-	// Create multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Add file
-	part, err := writer.CreateFormFile("file", filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %v", err)
-	}
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return "", fmt.Errorf("failed to copy file: %v", err)
-	}
-
-	// Add user ID
-	err = writer.WriteField("user_id", userID)
-	if err != nil {
-		return "", fmt.Errorf("failed to write user_id field: %v", err)
+// loadMLClient configures the ML service client from ML_SERVICE_URL and
+// ML_TIMEOUT
+func loadMLClient() (MLClient, error) {
+	baseURL := os.Getenv("ML_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = defaultMLServiceURL
 	}
-
-	err = writer.Close()
-	if err != nil {
-		return "", fmt.Errorf("failed to close writer: %v", err)
+	if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ML_SERVICE_URL %q", baseURL)
 	}
 
-	// Create request
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/pipeline", c.baseURL), body)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	// Send request
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("ML service error: %s", string(respBody))
-	}
-
-	// Parse response
-	var result struct {
-		NoteID string `json:"note_id"`
-	}
-	err = json.Unmarshal(respBody, &result)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse response: %v", err)
+	timeout := defaultMLTimeout
+	if value := os.Getenv("ML_TIMEOUT"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid ML_TIMEOUT %q", value)
+		}
+		// A stage that outlives the job lease would be run twice
+		if timeout*mlCallsPerStage >= jobLease {
+			return nil, fmt.Errorf("ML_TIMEOUT must be shorter than 1/%d of the %s job lease", mlCallsPerStage, jobLease)
+		}
 	}
+	return newHTTPMLClient(baseURL, timeout), nil
+}
 
-	return result.NoteID, nil
+// multipartFile streams a form with file as its "file" part. The form is
+// written as the request reads it, so a long recording is never held in
+// memory; a failure to read the file fails the request.
+func multipartFile(file io.Reader, filename string) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, err := writer.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		// A request that stopped reading closed pr, which ends the copy
+		pw.CloseWithError(err)
+	}()
+	return pr, writer.FormDataContentType()
 }
 
 type Block struct {
@@ -105,11 +118,40 @@ type ASRResponse struct {
 	Transcript string `json:"transcript"`
 }
 
-type PipelineResponse struct {
-	NoteID string `json:"note_id"`
+type SummaryRequest struct {
+	Text  string `json:"text"`
+	Style string `json:"style"`
 }
 
-func (c *MLClient) OCR(file io.Reader, filename string, userID string) ([]Block, error) {
+type SummaryResponse struct {
+	Summary string `json:"summary"`
+}
+
+type QARequest struct {
+	Text         string `json:"text"`
+	MaxQuestions int    `json:"max_questions"`
+}
+
+// QAPair is a generated question and its answer
+type QAPair struct {
+	Q string `json:"q"`
+	A string `json:"a"`
+}
+
+type QAResponse struct {
+	QAPairs []QAPair `json:"qa_pairs"`
+}
+
+type KeyphraseRequest struct {
+	Text string `json:"text"`
+	TopN int    `json:"top_n"`
+}
+
+type KeyphraseResponse struct {
+	Keyphrases []string `json:"keyphrases"`
+}
+
+func (c *httpMLClient) OCR(file io.Reader, filename string, userID string) ([]Block, error) {
 	var response OCRResponse
 	err := c.sendFileRequest("/ocr", file, filename, userID, &response)
 	if err != nil {
@@ -118,7 +160,7 @@ func (c *MLClient) OCR(file io.Reader, filename string, userID string) ([]Block,
 	return response.Blocks, nil
 }
 
-func (c *MLClient) ASR(file io.Reader, filename string, userID string) (string, error) {
+func (c *httpMLClient) ASR(file io.Reader, filename string, userID string) (string, error) {
 	var response ASRResponse
 	err := c.sendFileRequest("/asr", file, filename, userID, &response)
 	if err != nil {
@@ -127,26 +169,69 @@ func (c *MLClient) ASR(file io.Reader, filename string, userID string) (string,
 	return response.Transcript, nil
 }
 
-func (c *MLClient) sendFileRequest(endpoint string, file io.Reader, filename string, userID string, response interface{}) error {
-	// Create multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+func (c *httpMLClient) Summarize(text string) (string, error) {
+	var response SummaryResponse
+	err := c.sendJSONRequest("/summarize", SummaryRequest{Text: text, Style: "paragraph"}, &response)
+	if err != nil {
+		return "", fmt.Errorf("summarize request failed: %w", err)
+	}
+	return response.Summary, nil
+}
+
+func (c *httpMLClient) GenerateQA(text string, maxQuestions int) ([]QAPair, error) {
+	var response QAResponse
+	err := c.sendJSONRequest("/generate-qa", QARequest{Text: text, MaxQuestions: maxQuestions}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("QA request failed: %w", err)
+	}
+	return response.QAPairs, nil
+}
 
-	// Add file part
-	part, err := writer.CreateFormFile("file", filename)
+func (c *httpMLClient) Keyphrases(text string, topN int) ([]string, error) {
+	var response KeyphraseResponse
+	err := c.sendJSONRequest("/keyphrases", KeyphraseRequest{Text: text, TopN: topN}, &response)
 	if err != nil {
-		return fmt.Errorf("failed to create form file: %w", err)
+		return nil, fmt.Errorf("keyphrase request failed: %w", err)
 	}
+	return response.Keyphrases, nil
+}
 
-	_, err = io.Copy(part, file)
+// statusError describes a failed ML response. A 4xx means the service
+// rejected the input, so the job fails instead of being retried.
+func statusError(resp *http.Response) error {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	err := fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return fmt.Errorf("%w: %v", errUnprocessable, err)
+	}
+	return err
+}
+
+func (c *httpMLClient) sendJSONRequest(endpoint string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("failed to copy file: %w", err)
+		return fmt.Errorf("failed to encode request: %w", err)
 	}
 
-	err = writer.Close()
+	resp, err := c.httpClient.Post(c.baseURL+endpoint, "application/json", bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("failed to close writer: %w", err)
+		return fmt.Errorf("request failed: %w", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *httpMLClient) sendFileRequest(endpoint string, file io.Reader, filename string, userID string, response interface{}) error {
+	body, contentType := multipartFile(file, filename)
+	defer body.Close()
 
 	// Create request
 	req, err := http.NewRequest("POST", c.baseURL+endpoint, body)
@@ -155,7 +240,7 @@ func (c *MLClient) sendFileRequest(endpoint string, file io.Reader, filename str
 	}
 
 	// Set headers
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Content-Type", contentType)
 	if userID != "" {
 		req.Header.Set("X-User-ID", userID)
 	}
@@ -169,8 +254,7 @@ func (c *MLClient) sendFileRequest(endpoint string, file io.Reader, filename str
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return statusError(resp)
 	}
 
 	// Parse response
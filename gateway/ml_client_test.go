@@ -3,26 +3,21 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func setupTestServer(t *testing.T, handler http.HandlerFunc) (*MLClient, *httptest.Server) {
+func setupTestServer(t *testing.T, handler http.HandlerFunc) (*httpMLClient, *httptest.Server) {
 	server := httptest.NewServer(handler)
-	serverURL, err := url.Parse(server.URL)
-	assert.NoError(t, err)
-
-	client := NewMLClient()
-	client.client.Transport = &http.Transport{
-		Proxy: http.ProxyURL(serverURL),
-	}
-	client.baseURL = server.URL
+	client := newHTTPMLClient(server.URL+"/", defaultMLTimeout)
 
 	t.Cleanup(func() {
 		server.Close()
@@ -31,38 +26,43 @@ func setupTestServer(t *testing.T, handler http.HandlerFunc) (*MLClient, *httpte
 	return client, server
 }
 
-func TestMLClient_Pipeline(t *testing.T) {
-	client, _ := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
-		// Check method and path
-		assert.Equal(t, "/pipeline", r.URL.Path)
-		assert.Equal(t, "POST", r.Method)
-
-		// Check headers
-		assert.Contains(t, r.Header.Get("Content-Type"), "multipart/form-data")
-		assert.Equal(t, "test-user", r.Header.Get("X-User-ID"))
-
-		// Check file
-		file, header, err := r.FormFile("file")
-		assert.NoError(t, err)
-		assert.Equal(t, "test.txt", header.Filename)
-		content, err := io.ReadAll(file)
-		assert.NoError(t, err)
-		assert.Equal(t, "test content", string(content))
-
-		// Send response
-		json.NewEncoder(w).Encode(PipelineResponse{NoteID: "test-note-id"})
-	})
+func TestLoadMLClient(t *testing.T) {
+	t.Setenv("ML_SERVICE_URL", "")
+	t.Setenv("ML_TIMEOUT", "")
+	client, err := loadMLClient()
+	assert.NoError(t, err)
+	if assert.IsType(t, &httpMLClient{}, client) {
+		assert.Equal(t, defaultMLServiceURL, client.(*httpMLClient).baseURL)
+		assert.Equal(t, defaultMLTimeout, client.(*httpMLClient).httpClient.Timeout)
+	}
 
-	// Test request
-	noteID, err := client.Pipeline(
-		bytes.NewBufferString("test content"),
-		"test.txt",
-		"test-user",
-	)
+	t.Setenv("ML_SERVICE_URL", "https://ml.internal:9000/")
+	t.Setenv("ML_TIMEOUT", "90s")
+	client, err = loadMLClient()
+	assert.NoError(t, err)
+	if assert.IsType(t, &httpMLClient{}, client) {
+		assert.Equal(t, "https://ml.internal:9000", client.(*httpMLClient).baseURL)
+		assert.Equal(t, 90*time.Second, client.(*httpMLClient).httpClient.Timeout)
+	}
 
-	// Check results
+	// Both calls of the summarise stage fit in one lease
+	t.Setenv("ML_TIMEOUT", "7m29s")
+	_, err = loadMLClient()
 	assert.NoError(t, err)
-	assert.Equal(t, "test-note-id", noteID)
+
+	for _, env := range []struct{ url, timeout string }{
+		{"ml:8000", ""},
+		{"ftp://ml:8000", ""},
+		{"http://ml:8000", "soon"},
+		{"http://ml:8000", "-1s"},
+		{"http://ml:8000", "7m30s"},
+		{"http://ml:8000", "1h"},
+	} {
+		t.Setenv("ML_SERVICE_URL", env.url)
+		t.Setenv("ML_TIMEOUT", env.timeout)
+		_, err = loadMLClient()
+		assert.Error(t, err, env)
+	}
 }
 
 func TestMLClient_OCR(t *testing.T) {
@@ -110,33 +110,130 @@ func TestMLClient_ASR(t *testing.T) {
 	assert.Equal(t, "test transcript", transcript)
 }
 
+func TestMLClient_TextEndpoints(t *testing.T) {
+	client, _ := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		switch r.URL.Path {
+		case "/summarize":
+			var req SummaryRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, "lecture text", req.Text)
+			json.NewEncoder(w).Encode(SummaryResponse{Summary: "short"})
+		case "/generate-qa":
+			var req QARequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, 5, req.MaxQuestions)
+			json.NewEncoder(w).Encode(QAResponse{QAPairs: []QAPair{{Q: "What?", A: "That."}}})
+		case "/keyphrases":
+			json.NewEncoder(w).Encode(KeyphraseResponse{Keyphrases: []string{"cells"}})
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	})
+
+	summary, err := client.Summarize("lecture text")
+	assert.NoError(t, err)
+	assert.Equal(t, "short", summary)
+
+	pairs, err := client.GenerateQA("lecture text", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []QAPair{{Q: "What?", A: "That."}}, pairs)
+
+	keyphrases, err := client.Keyphrases("lecture text", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cells"}, keyphrases)
+}
+
 func TestMLClient_ErrorHandling(t *testing.T) {
 	client, _ := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("invalid request"))
 	})
 
-	_, err := client.Pipeline(
-		bytes.NewBufferString("test content"),
-		"test.txt",
+	_, err := client.OCR(
+		bytes.NewBufferString("test image"),
+		"test.jpg",
 		"test-user",
 	)
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid request")
+	assert.ErrorIs(t, err, errUnprocessable)
+
+	// Failures on the service's side may pass on a retry
+	client, _ = setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	_, err = client.Summarize("lecture text")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errUnprocessable)
 }
 
 func TestMLClient_Timeout(t *testing.T) {
 	client, _ := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(6 * time.Second)
 	})
+	client.httpClient.Timeout = time.Second
 
-	_, err := client.Pipeline(
-		bytes.NewBufferString("test content"),
-		"test.txt",
+	_, err := client.OCR(
+		bytes.NewBufferString("test image"),
+		"test.jpg",
 		"test-user",
 	)
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "deadline exceeded")
 }
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("disk gone")
+}
+
+func TestMLClient_StreamsFile(t *testing.T) {
+	var received int64
+	client, _ := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The form is sent as it is written, without a length
+		assert.Equal(t, int64(-1), r.ContentLength)
+		file, _, err := r.FormFile("file")
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received, _ = io.Copy(io.Discard, file)
+		json.NewEncoder(w).Encode(ASRResponse{Transcript: "long lecture"})
+	})
+
+	_, err := client.ASR(io.LimitReader(zeroReader{}, 8<<20), "lecture.mp3", "test-user")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8<<20), received)
+
+	// A file that cannot be read fails the request
+	_, err = client.ASR(io.MultiReader(strings.NewReader("ID3"), failingReader{}), "lecture.mp3", "test-user")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "disk gone")
+}
+
+// BenchmarkMLClient_ASR sends recordings of growing size to the ML
+// service. Memory per request stays flat as the form is streamed.
+func BenchmarkMLClient_ASR(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		json.NewEncoder(w).Encode(ASRResponse{Transcript: "long lecture"})
+	}))
+	defer server.Close()
+	client := newHTTPMLClient(server.URL, defaultMLTimeout)
+
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.ASR(io.LimitReader(zeroReader{}, size), "lecture.mp3", "user-1"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultNotePageSize = 20
+	maxNotePageSize     = 100
+	defaultNoteSort     = "-created_at"
+)
+
+// noteSortColumns are the orders a note listing accepts, with a leading
+// "-" for descending. The id breaks ties so the order is total.
+var noteSortColumns = map[string]string{
+	"created_at": "n.created_at",
+	"updated_at": "n.updated_at",
+	"title":      "n.title",
+}
+
+// noteSources are the source type filters, matched on what the ML pipeline
+// extracted from the upload
+var noteSources = map[string]string{
+	"image": "EXISTS (SELECT 1 FROM ocr_blocks o WHERE o.note_id = n.id)",
+	"audio": "EXISTS (SELECT 1 FROM audio_notes a WHERE a.note_id = n.id)",
+}
+
+// noteOptionalFields are left out of list views unless asked for in fields
+var noteOptionalFields = []string{"content"}
+
+// noteCursor is the position after the last note of a page. It carries the
+// sort it was issued for, since it is meaningless under another order.
+type noteCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (cur noteCursor) encode() string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeNoteCursor(s string) (*noteCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cur noteCursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+	if cur.ID == "" || !validNoteID(cur.ID) {
+		return nil, fmt.Errorf("cursor has no valid id")
+	}
+	return &cur, nil
+}
+
+// noteListQuery is a parsed note listing request
+type noteListQuery struct {
+	Limit      int
+	Sort       string
+	Descending bool
+	Cursor     *noteCursor
+	NotebookID string
+	Tags       []string
+	From       *time.Time
+	To         *time.Time
+	Source     string
+	Fields     map[string]bool
+}
+
+// parseNoteListQuery reads limit, cursor, sort, notebook, tag, from, to,
+// source and fields from the query string
+func parseNoteListQuery(c *fiber.Ctx) (noteListQuery, FieldErrors) {
+	errs := FieldErrors{}
+	q := noteListQuery{
+		Limit:  defaultNotePageSize,
+		Sort:   defaultNoteSort,
+		Fields: map[string]bool{},
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxNotePageSize {
+			errs["limit"] = fmt.Sprintf("Limit must be between 1 and %d", maxNotePageSize)
+		}
+		q.Limit = n
+	}
+
+	// A notebook that is not the user's matches nothing
+	if notebook := c.Query("notebook"); notebook != "" {
+		if !validNoteID(notebook) {
+			errs["notebook"] = "Invalid notebook id"
+		}
+		q.NotebookID = notebook
+	}
+
+	// Several comma-separated tags must all be present
+	for _, tag := range splitList(c.Query("tag")) {
+		q.Tags = append(q.Tags, normalizeTag(tag))
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		q.Sort = sort
+	}
+	if _, ok := noteSortColumns[strings.TrimPrefix(q.Sort, "-")]; !ok {
+		errs["sort"] = "Sort must be one of created_at, updated_at or title, with a leading - for descending"
+	}
+	q.Descending = strings.HasPrefix(q.Sort, "-")
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		cur, err := decodeNoteCursor(cursor)
+		if err != nil {
+			errs["cursor"] = "Invalid cursor"
+		} else if cur.Sort != q.Sort {
+			errs["cursor"] = "Cursor belongs to a different sort"
+		}
+		q.Cursor = cur
+	}
+
+	var err error
+	if q.From, err = parseDateParam(c.Query("from"), false); err != nil {
+		errs["from"] = "From must be a date or an RFC 3339 time"
+	}
+	if q.To, err = parseDateParam(c.Query("to"), true); err != nil {
+		errs["to"] = "To must be a date or an RFC 3339 time"
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		errs["to"] = "To must be after from"
+	}
+
+	if source := c.Query("source"); source != "" {
+		if _, ok := noteSources[source]; !ok {
+			errs["source"] = "Source must be image or audio"
+		}
+		q.Source = source
+	}
+
+	for _, field := range splitList(c.Query("fields")) {
+		if !containsString(noteOptionalFields, field) {
+			errs["fields"] = fmt.Sprintf("Unknown field %q", field)
+			break
+		}
+		q.Fields[field] = true
+	}
+
+	return q, errs
+}
+
+// parseDateParam accepts an RFC 3339 time or a date. A date used as an
+// upper bound means the end of that day.
+func parseDateParam(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// queryArgs numbers positional parameters as they are added
+type queryArgs []interface{}
+
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// filter returns the WHERE clause shared by the page and the total count
+func (q noteListQuery) filter(userID string, args *queryArgs) string {
+	conditions := []string{"n.user_id = " + args.add(userID)}
+	if q.NotebookID != "" {
+		conditions = append(conditions, "n.notebook_id = "+args.add(q.NotebookID))
+	}
+	for _, tag := range q.Tags {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM tags t WHERE t.note_id = n.id AND t.tag = "+args.add(tag)+")")
+	}
+	if q.From != nil {
+		conditions = append(conditions, "n.created_at >= "+args.add(*q.From))
+	}
+	if q.To != nil {
+		conditions = append(conditions, "n.created_at < "+args.add(*q.To))
+	}
+	if q.Source != "" {
+		conditions = append(conditions, noteSources[q.Source])
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// pageQuery selects one page plus one extra row, which tells whether a
+// next page exists. Quiz cards are aggregated for the page's notes only.
+func (q noteListQuery) pageQuery(userID string) (string, []interface{}) {
+	args := queryArgs{}
+	content := "''"
+	if q.Fields["content"] {
+		content = "n.content"
+	}
+	column := noteSortColumns[strings.TrimPrefix(q.Sort, "-")]
+	direction, comparison := "ASC", ">"
+	if q.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	query := `
+		SELECT n.id, COALESCE(n.title, ''), ` + content + `, n.summary, n.created_at, n.updated_at,
+			COALESCE((SELECT json_agg(json_build_object(
+				'id', q.id,
+				'note_id', q.note_id,
+				'question', q.question,
+				'answer', q.answer
+			)) FROM quiz_cards q WHERE q.note_id = n.id), '[]') as quiz_cards,
+			` + noteTagsColumn + `,
+			n.notebook_id
+		FROM notes n` + q.filter(userID, &args)
+	if q.Cursor != nil {
+		query += fmt.Sprintf(" AND (%s, n.id) %s (%s, %s)", column, comparison, args.add(q.Cursor.Value), args.add(q.Cursor.ID))
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, n.id %s LIMIT %s", column, direction, direction, args.add(q.Limit+1))
+	return query, args
+}
+
+func (q noteListQuery) countQuery(userID string) (string, []interface{}) {
+	args := queryArgs{}
+	return "SELECT COUNT(*) FROM notes n" + q.filter(userID, &args), args
+}
+
+// cursorAfter returns the cursor that continues after note
+func (q noteListQuery) cursorAfter(note Note) string {
+	cur := noteCursor{Sort: q.Sort, ID: note.ID}
+	switch strings.TrimPrefix(q.Sort, "-") {
+	case "created_at":
+		cur.Value = note.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		cur.Value = note.UpdatedAt.Format(time.RFC3339Nano)
+	case "title":
+		cur.Value = note.Title
+	}
+	return cur.encode()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+const maxNotebookNameLength = 100
+
+// Notebook groups notes, usually by course
+type Notebook struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	ExamDate  *time.Time `json:"exam_date"`
+	NoteCount int        `json:"note_count"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type CreateNotebookRequest struct {
+	Name     string     `json:"name"`
+	ExamDate *time.Time `json:"exam_date"`
+}
+
+// UpdateNotebookRequest edits the fields that are present; a null
+// exam_date removes it
+type UpdateNotebookRequest struct {
+	Name     *string             `json:"name"`
+	ExamDate Nullable[time.Time] `json:"exam_date"`
+}
+
+const notebookSelect = `
+	SELECT b.id, b.name, b.exam_date,
+		(SELECT COUNT(*) FROM notes n WHERE n.notebook_id = b.id),
+		b.created_at, b.updated_at
+	FROM notebooks b
+`
+
+func scanNotebook(row interface{ Scan(...interface{}) error }) (Notebook, error) {
+	var notebook Notebook
+	var examDate sql.NullTime
+	err := row.Scan(&notebook.ID, &notebook.Name, &examDate, &notebook.NoteCount, &notebook.CreatedAt, &notebook.UpdatedAt)
+	if examDate.Valid {
+		notebook.ExamDate = &examDate.Time
+	}
+	return notebook, err
+}
+
+func notebookNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Notebook not found",
+	})
+}
+
+func notebookNameTaken(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": "A notebook with this name already exists",
+	})
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation"
+}
+
+// validateNotebookName trims the name in place
+func validateNotebookName(name *string) string {
+	*name = strings.TrimSpace(*name)
+	if *name == "" {
+		return "Name is required"
+	}
+	if len(*name) > maxNotebookNameLength {
+		return fmt.Sprintf("Name must be at most %d characters", maxNotebookNameLength)
+	}
+	return ""
+}
+
+// ownsNotebook tells whether the notebook exists and belongs to the user
+func ownsNotebook(userID, notebookID string) (bool, error) {
+	if !validNoteID(notebookID) {
+		return false, nil
+	}
+	var owned bool
+	err := db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM notebooks WHERE id = $1 AND user_id = $2)",
+		notebookID,
+		userID,
+	).Scan(&owned)
+	return owned, err
+}
+
+func findNotebook(c *fiber.Ctx, notebookID string) error {
+	notebook, err := scanNotebook(db.QueryRow(
+		notebookSelect+" WHERE b.id = $1 AND b.user_id = $2",
+		notebookID,
+		currentUserID(c),
+	))
+	if err == sql.ErrNoRows {
+		return notebookNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get notebook",
+		})
+	}
+	return c.JSON(notebook)
+}
+
+func createNotebook(c *fiber.Ctx) error {
+	var req CreateNotebookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if msg := validateNotebookName(&req.Name); msg != "" {
+		return validationError(c, FieldErrors{"name": msg})
+	}
+
+	var id string
+	err := db.QueryRow(
+		"INSERT INTO notebooks (user_id, name, exam_date) VALUES ($1, $2, $3) RETURNING id",
+		currentUserID(c),
+		req.Name,
+		req.ExamDate,
+	).Scan(&id)
+	if isUniqueViolation(err) {
+		return notebookNameTaken(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create notebook",
+		})
+	}
+
+	c.Status(fiber.StatusCreated)
+	return findNotebook(c, id)
+}
+
+// listNotebooks returns the user's notebooks by name with their note counts
+func listNotebooks(c *fiber.Ctx) error {
+	rows, err := db.Query(notebookSelect+" WHERE b.user_id = $1 ORDER BY lower(b.name) ASC", currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch notebooks",
+		})
+	}
+	defer rows.Close()
+
+	notebooks := []Notebook{}
+	for rows.Next() {
+		notebook, err := scanNotebook(rows)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan notebook",
+			})
+		}
+		notebooks = append(notebooks, notebook)
+	}
+
+	return c.JSON(notebooks)
+}
+
+func getNotebook(c *fiber.Ctx) error {
+	notebookID := c.Params("id")
+	if !validNoteID(notebookID) {
+		return notebookNotFound(c)
+	}
+	return findNotebook(c, notebookID)
+}
+
+func updateNotebook(c *fiber.Ctx) error {
+	notebookID := c.Params("id")
+	if !validNoteID(notebookID) {
+		return notebookNotFound(c)
+	}
+
+	var req UpdateNotebookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Name == nil && !req.ExamDate.Set {
+		return validationError(c, FieldErrors{"notebook": "Nothing to update"})
+	}
+	if req.Name != nil {
+		if msg := validateNotebookName(req.Name); msg != "" {
+			return validationError(c, FieldErrors{"name": msg})
+		}
+	}
+
+	result, err := db.Exec(
+		`UPDATE notebooks SET
+			name = COALESCE($3, name),
+			exam_date = CASE WHEN $4 THEN $5 ELSE exam_date END
+		WHERE id = $1 AND user_id = $2`,
+		notebookID,
+		currentUserID(c),
+		req.Name,
+		req.ExamDate.Set,
+		req.ExamDate.Value,
+	)
+	if isUniqueViolation(err) {
+		return notebookNameTaken(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update notebook",
+		})
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return notebookNotFound(c)
+	}
+
+	return findNotebook(c, notebookID)
+}
+
+// deleteNotebook removes a notebook; its notes are kept and unassigned
+func deleteNotebook(c *fiber.Ctx) error {
+	notebookID := c.Params("id")
+	if !validNoteID(notebookID) {
+		return notebookNotFound(c)
+	}
+
+	result, err := db.Exec("DELETE FROM notebooks WHERE id = $1 AND user_id = $2", notebookID, currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete notebook",
+		})
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return notebookNotFound(c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// getNotebookNotes lists a notebook's notes, with the same paging, filters
+// and sorting as the note listing
+func getNotebookNotes(c *fiber.Ctx) error {
+	q, errs := parseNoteListQuery(c)
+	if len(errs) > 0 {
+		return validationError(c, errs)
+	}
+
+	owned, err := ownsNotebook(currentUserID(c), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get notebook",
+		})
+	}
+	if !owned {
+		return notebookNotFound(c)
+	}
+
+	q.NotebookID = c.Params("id")
+	return listNotes(c, q)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+const testNotebookID = "3d2a7c9e-5b1f-4e8a-9c6d-0f4b2e1a7d35"
+
+var notebookColumns = []string{"id", "name", "exam_date", "note_count", "created_at", "updated_at"}
+
+func expectNotebookOwned(mock sqlmock.Sqlmock, userID string, owned bool) {
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM notebooks WHERE id = \\$1 AND user_id = \\$2\\)").
+		WithArgs(testNotebookID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(owned))
+}
+
+func TestCreateNotebook(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notebooks", withUser("user-1"), createNotebook)
+
+	examDate := time.Date(2026, 12, 14, 9, 0, 0, 0, time.UTC)
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO notebooks \\(user_id, name, exam_date\\)").
+		WithArgs("user-1", "CS101", &examDate).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testNotebookID))
+	mock.ExpectQuery("FROM notebooks b WHERE b.id = \\$1 AND b.user_id = \\$2").
+		WithArgs(testNotebookID, "user-1").
+		WillReturnRows(sqlmock.NewRows(notebookColumns).AddRow(testNotebookID, "CS101", examDate, 0, now, now))
+
+	req := httptest.NewRequest("POST", "/api/notebooks", strings.NewReader(`{"name":" CS101 ","exam_date":"2026-12-14T09:00:00Z"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var notebook Notebook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&notebook))
+	assert.Equal(t, "CS101", notebook.Name)
+	if assert.NotNil(t, notebook.ExamDate) {
+		assert.True(t, examDate.Equal(*notebook.ExamDate))
+	}
+}
+
+func TestCreateNotebook_Rejected(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notebooks", withUser("user-1"), createNotebook)
+
+	for _, body := range []string{`{"name":"  "}`, `{"name":"` + strings.Repeat("a", maxNotebookNameLength+1) + `"}`} {
+		req := httptest.NewRequest("POST", "/api/notebooks", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	// Names are unique per user, ignoring case
+	mock.ExpectQuery("INSERT INTO notebooks").
+		WithArgs("user-1", "cs101", nil).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "notebooks_user_id_name_idx"})
+
+	req := httptest.NewRequest("POST", "/api/notebooks", strings.NewReader(`{"name":"cs101"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListNotebooks(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notebooks", withUser("user-1"), listNotebooks)
+
+	now := time.Now()
+	mock.ExpectQuery("FROM notebooks b WHERE b.user_id = \\$1 ORDER BY lower\\(b.name\\)").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(notebookColumns).
+			AddRow(testNotebookID, "CS101", now, 3, now, now).
+			AddRow("9a1e4b7c-2d3f-4a5b-8c6d-7e8f9a0b1c2d", "Organic Chem", nil, 0, now, now))
+
+	req := httptest.NewRequest("GET", "/api/notebooks", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var notebooks []Notebook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&notebooks))
+	if assert.Len(t, notebooks, 2) {
+		assert.Equal(t, 3, notebooks[0].NoteCount)
+		assert.Nil(t, notebooks[1].ExamDate)
+	}
+}
+
+func TestUpdateNotebook_ClearsExamDate(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notebooks/:id", withUser("user-1"), updateNotebook)
+
+	// A null exam date is sent on, an absent name keeps the old one
+	now := time.Now()
+	mock.ExpectExec("UPDATE notebooks SET").
+		WithArgs(testNotebookID, "user-1", nil, true, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM notebooks b WHERE b.id = \\$1 AND b.user_id = \\$2").
+		WithArgs(testNotebookID, "user-1").
+		WillReturnRows(sqlmock.NewRows(notebookColumns).AddRow(testNotebookID, "CS101", nil, 3, now, now))
+
+	req := httptest.NewRequest("PATCH", "/api/notebooks/"+testNotebookID, strings.NewReader(`{"exam_date":null}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var notebook Notebook
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&notebook))
+	assert.Nil(t, notebook.ExamDate)
+}
+
+func TestUpdateNotebook_NothingToUpdate(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notebooks/:id", withUser("user-1"), updateNotebook)
+
+	req := httptest.NewRequest("PATCH", "/api/notebooks/"+testNotebookID, strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteNotebook(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/api/notebooks/:id", withUser("user-1"), deleteNotebook)
+
+	mock.ExpectExec("DELETE FROM notebooks WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testNotebookID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM notebooks WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testNotebookID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest("DELETE", "/api/notebooks/"+testNotebookID, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	req = httptest.NewRequest("DELETE", "/api/notebooks/"+testNotebookID, nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotebookNotes(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notebooks/:id/notes", withUser("user-1"), getNotebookNotes)
+
+	expectNotebookOwned(mock, "user-1", true)
+	filter := regexp.QuoteMeta("WHERE n.user_id = $1 AND n.notebook_id = $2")
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n "+filter).
+		WithArgs("user-1", testNotebookID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	now := time.Now()
+	mock.ExpectQuery(filter).
+		WithArgs("user-1", testNotebookID, defaultNotePageSize+1).
+		WillReturnRows(sqlmock.NewRows(noteColumns).AddRow(testNoteID, "Cells", "", "Energy", now, now, "[]", "{}", testNotebookID))
+
+	req := httptest.NewRequest("GET", "/api/notebooks/"+testNotebookID+"/notes", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Total-Count"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotebookNotes_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notebooks/:id/notes", withUser("user-1"), getNotebookNotes)
+
+	expectNotebookOwned(mock, "user-1", false)
+
+	req := httptest.NewRequest("GET", "/api/notebooks/"+testNotebookID+"/notes", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateNote_MovesToNotebook(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notes/:id", withUser("user-1"), updateNote)
+
+	notebookID := testNotebookID
+	expectNotebookOwned(mock, "user-1", true)
+	mock.ExpectExec("UPDATE notes SET").
+		WithArgs(testNoteID, "user-1", nil, nil, nil, true, &notebookID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	now := time.Now()
+	mock.ExpectQuery("WHERE n.id = \\$1 AND n.user_id = \\$2").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows(noteColumns).AddRow(testNoteID, "Cells", "Mitochondria", "Energy", now, now, "[]", "{}", testNotebookID))
+
+	req := httptest.NewRequest("PATCH", "/api/notes/"+testNoteID, strings.NewReader(`{"notebook_id":"`+testNotebookID+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Someone else's notebook is refused
+	expectNotebookOwned(mock, "user-1", false)
+
+	req = httptest.NewRequest("PATCH", "/api/notes/"+testNoteID, strings.NewReader(`{"notebook_id":"`+testNotebookID+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUploadNote_UnknownNotebook(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes", withUser("user-1"), uploadNote)
+
+	// Refused before anything reaches the ML service
+	expectNotebookOwned(mock, "user-1", false)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "scan.png")
+	assert.NoError(t, err)
+	part.Write([]byte("lecture scan"))
+	writer.WriteField("notebook_id", testNotebookID)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/notes", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const maxNoteTitleLength = 200
+
+// noteTagsColumn selects a note's tags in name order
+const noteTagsColumn = `COALESCE((SELECT array_agg(t.tag ORDER BY t.tag) FROM tags t WHERE t.note_id = n.id), '{}') as tags`
+
+// noteSelect selects notes with their quiz cards, tags and notebook;
+// callers add the WHERE and GROUP BY n.id
+const noteSelect = `
+	SELECT n.id, COALESCE(n.title, ''), n.content, n.summary, n.created_at, n.updated_at,
+		   COALESCE(json_agg(json_build_object(
+			   'id', q.id,
+			   'note_id', q.note_id,
+			   'question', q.question,
+			   'answer', q.answer
+		   )) FILTER (WHERE q.id IS NOT NULL), '[]') as quiz_cards,
+		   ` + noteTagsColumn + `,
+		   n.notebook_id
+	FROM notes n
+	LEFT JOIN quiz_cards q ON n.id = q.note_id
+`
+
+// noteDeletes remove what hangs off a note before the note itself, for
+// databases whose note tables do not cascade
+var noteDeletes = []string{
+	"DELETE FROM quiz_cards WHERE note_id = $1",
+	"DELETE FROM ocr_blocks WHERE note_id = $1",
+	"DELETE FROM audio_notes WHERE note_id = $1",
+	"DELETE FROM tags WHERE note_id = $1",
+	"DELETE FROM study_blocks WHERE note_id = $1",
+}
+
+// UpdateNoteRequest edits the fields that are present; a null notebook_id
+// takes the note out of its notebook
+type UpdateNoteRequest struct {
+	Title      *string          `json:"title"`
+	Content    *string          `json:"content"`
+	Summary    *string          `json:"summary"`
+	NotebookID Nullable[string] `json:"notebook_id"`
+}
+
+func scanNote(row interface{ Scan(...interface{}) error }) (Note, error) {
+	var note Note
+	var notebookID sql.NullString
+	err := row.Scan(&note.ID, &note.Title, &note.Content, &note.Summary, &note.CreatedAt, &note.UpdatedAt, &note.QuizCards, pq.Array(&note.Tags), &notebookID)
+	if notebookID.Valid {
+		note.NotebookID = &notebookID.String
+	}
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	return note, err
+}
+
+// validNoteID keeps malformed ids away from the uuid columns, where they
+// would be a database error rather than a missing note
+func validNoteID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+func noteNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Note not found",
+	})
+}
+
+// validateUpdateNote normalises the request in place and reports invalid
+// fields
+func validateUpdateNote(req *UpdateNoteRequest) FieldErrors {
+	errs := FieldErrors{}
+	if req.Title == nil && req.Content == nil && req.Summary == nil && !req.NotebookID.Set {
+		errs["note"] = "Nothing to update"
+		return errs
+	}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		req.Title = &title
+		if title == "" {
+			errs["title"] = "Title is required"
+		} else if len(title) > maxNoteTitleLength {
+			errs["title"] = fmt.Sprintf("Title must be at most %d characters", maxNoteTitleLength)
+		}
+	}
+	if req.Content != nil && strings.TrimSpace(*req.Content) == "" {
+		errs["content"] = "Content cannot be empty"
+	}
+	return errs
+}
+
+// getNotes lists one page of the user's notes. The total matching the
+// filters is in X-Total-Count and the next page's cursor in X-Next-Cursor.
+func getNotes(c *fiber.Ctx) error {
+	q, errs := parseNoteListQuery(c)
+	if len(errs) > 0 {
+		return validationError(c, errs)
+	}
+	return listNotes(c, q)
+}
+
+func listNotes(c *fiber.Ctx, q noteListQuery) error {
+	userID := currentUserID(c)
+
+	var total int
+	countQuery, countArgs := q.countQuery(userID)
+	if err := db.QueryRow(countQuery, countArgs...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to count notes",
+		})
+	}
+
+	pageQuery, pageArgs := q.pageQuery(userID)
+	rows, err := db.Query(pageQuery, pageArgs...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch notes",
+		})
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan note",
+			})
+		}
+		notes = append(notes, note)
+	}
+
+	c.Set("X-Total-Count", strconv.Itoa(total))
+	if len(notes) > q.Limit {
+		notes = notes[:q.Limit]
+		c.Set("X-Next-Cursor", q.cursorAfter(notes[len(notes)-1]))
+	}
+	return c.JSON(notes)
+}
+
+func getNote(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	note, err := scanNote(db.QueryRow(
+		noteSelect+" WHERE n.id = $1 AND n.user_id = $2 GROUP BY n.id",
+		noteID,
+		currentUserID(c),
+	))
+	if err == sql.ErrNoRows {
+		return noteNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get note",
+		})
+	}
+	return c.JSON(note)
+}
+
+// updateNote edits a note the user owns; the update_notes_updated_at
+// trigger moves updated_at
+func updateNote(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	var req UpdateNoteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if errs := validateUpdateNote(&req); len(errs) > 0 {
+		return validationError(c, errs)
+	}
+	userID := currentUserID(c)
+
+	if req.NotebookID.Value != nil {
+		owned, err := ownsNotebook(userID, *req.NotebookID.Value)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get notebook",
+			})
+		}
+		if !owned {
+			return validationError(c, FieldErrors{"notebook_id": "Notebook not found"})
+		}
+	}
+
+	result, err := db.Exec(
+		`UPDATE notes SET
+			title = COALESCE($3, title),
+			content = COALESCE($4, content),
+			summary = COALESCE($5, summary),
+			notebook_id = CASE WHEN $6 THEN $7::uuid ELSE notebook_id END
+		WHERE id = $1 AND user_id = $2`,
+		noteID,
+		userID,
+		req.Title,
+		req.Content,
+		req.Summary,
+		req.NotebookID.Set,
+		req.NotebookID.Value,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update note",
+		})
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return noteNotFound(c)
+	}
+
+	return getNote(c)
+}
+
+// deleteNote removes a note the user owns along with its quiz cards, study
+// blocks and the other rows generated from it, then its stored uploads
+func deleteNote(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+	userID := currentUserID(c)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	// Lock the note, which also checks ownership
+	err = tx.QueryRow("SELECT id FROM notes WHERE id = $1 AND user_id = $2 FOR UPDATE", noteID, userID).Scan(&noteID)
+	if err == sql.ErrNoRows {
+		return noteNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get note",
+		})
+	}
+
+	for _, query := range noteDeletes {
+		if _, err := tx.Exec(query, noteID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete note",
+			})
+		}
+	}
+	fileIDs, err := deleteNoteFiles(tx, noteID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete note",
+		})
+	}
+	if _, err := tx.Exec("DELETE FROM notes WHERE id = $1", noteID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete note",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	for _, fileID := range fileIDs {
+		if err := removeUpload(userID, fileID); err != nil {
+			log.Printf("[ERROR] Failed to remove upload %s: %v", fileID, err)
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// deleteNoteFiles deletes the note's file rows and returns their ids so
+// the files can be removed once the transaction commits
+func deleteNoteFiles(tx *sql.Tx, noteID string) ([]string, error) {
+	rows, err := tx.Query("DELETE FROM note_files WHERE note_id = $1 RETURNING id", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testNoteID = "8f0c6f7e-2a57-4a43-9d4b-3f1f6a3c2b10"
+
+var noteColumns = []string{"id", "title", "content", "summary", "created_at", "updated_at", "quiz_cards", "tags", "notebook_id"}
+
+func TestGetNote(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id", withUser("user-1"), getNote)
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT n.id, COALESCE\\(n.title, ''\\), .* WHERE n.id = \\$1 AND n.user_id = \\$2").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow(testNoteID, "Cells", "Mitochondria", "Energy", now, now, `[{"id":"card-1","note_id":"`+testNoteID+`","question":"Q","answer":"A"}]`, "{biology,cells}", testNotebookID))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var note Note
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&note))
+	assert.Equal(t, "Cells", note.Title)
+	assert.Len(t, note.QuizCards, 1)
+	assert.Equal(t, []string{"biology", "cells"}, note.Tags)
+	if assert.NotNil(t, note.NotebookID) {
+		assert.Equal(t, testNotebookID, *note.NotebookID)
+	}
+}
+
+func TestGetNote_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id", withUser("user-1"), getNote)
+
+	// Someone else's note looks the same as a missing one
+	mock.ExpectQuery("WHERE n.id = \\$1 AND n.user_id = \\$2").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows(noteColumns))
+
+	for _, id := range []string{testNoteID, "not-a-uuid"} {
+		req := httptest.NewRequest("GET", "/api/notes/"+id, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, id)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateNote(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notes/:id", withUser("user-1"), updateNote)
+
+	// Only the fields sent are changed
+	title := "Cell biology"
+	mock.ExpectExec("UPDATE notes SET").
+		WithArgs(testNoteID, "user-1", &title, nil, nil, false, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	now := time.Now()
+	mock.ExpectQuery("WHERE n.id = \\$1 AND n.user_id = \\$2").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows(noteColumns).AddRow(testNoteID, title, "Mitochondria", "Energy", now, now, "[]", "{}", nil))
+
+	req := httptest.NewRequest("PATCH", "/api/notes/"+testNoteID, strings.NewReader(`{"title":"  Cell biology "}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var note Note
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&note))
+	assert.Equal(t, title, note.Title)
+}
+
+func TestUpdateNote_Validation(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notes/:id", withUser("user-1"), updateNote)
+
+	for _, body := range []string{`{}`, `{"title":"  "}`, `{"content":""}`, `{"title":"` + strings.Repeat("a", maxNoteTitleLength+1) + `"}`} {
+		req := httptest.NewRequest("PATCH", "/api/notes/"+testNoteID, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateNote_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/notes/:id", withUser("user-1"), updateNote)
+
+	mock.ExpectExec("UPDATE notes SET").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest("PATCH", "/api/notes/"+testNoteID, strings.NewReader(`{"summary":"Short"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteNote(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	uploadDir = t.TempDir()
+	app.Delete("/api/notes/:id", withUser("user-1"), deleteNote)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadDir, "user-1"), 0o700))
+	assert.NoError(t, os.WriteFile(uploadPath("user-1", "file-1"), []byte("scan"), 0o600))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM notes WHERE id = \\$1 AND user_id = \\$2 FOR UPDATE").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testNoteID))
+	for _, query := range noteDeletes {
+		mock.ExpectExec(regexp.QuoteMeta(query)).
+			WithArgs(testNoteID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("DELETE FROM note_files WHERE note_id = \\$1 RETURNING id").
+		WithArgs(testNoteID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("file-1"))
+	mock.ExpectExec("DELETE FROM notes WHERE id = \\$1").
+		WithArgs(testNoteID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("DELETE", "/api/notes/"+testNoteID, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = os.Stat(uploadPath("user-1", "file-1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeleteNote_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/api/notes/:id", withUser("user-1"), deleteNote)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM notes WHERE id = \\$1 AND user_id = \\$2 FOR UPDATE").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("DELETE", "/api/notes/"+testNoteID, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotes_Pagination(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes", withUser("user-1"), getNotes)
+
+	// One row more than the limit means there is a next page
+	now := time.Now().UTC()
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n WHERE n.user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("ORDER BY n.created_at DESC, n.id DESC LIMIT \\$2").
+		WithArgs("user-1", 3).
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow(testNoteID, "Cells", "", "Energy", now, now, "[]", "{}", nil).
+			AddRow("1b4e28ba-2fa1-41d2-883f-0016d3cca427", "Atoms", "", "Matter", now.Add(-time.Hour), now, "[]", "{}", nil).
+			AddRow("6ba7b810-9dad-41d1-80b4-00c04fd430c8", "Stars", "", "Fusion", now.Add(-2*time.Hour), now, "[]", "{}", nil))
+
+	req := httptest.NewRequest("GET", "/api/notes?limit=2", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("X-Total-Count"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var notes []map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&notes))
+	if assert.Len(t, notes, 2) {
+		assert.NotContains(t, notes[0], "content")
+	}
+
+	// The cursor continues after the last note returned
+	cursor, err := decodeNoteCursor(resp.Header.Get("X-Next-Cursor"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1b4e28ba-2fa1-41d2-883f-0016d3cca427", cursor.ID)
+		assert.Equal(t, "-created_at", cursor.Sort)
+	}
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("AND \\(n.created_at, n.id\\) < \\(\\$2, \\$3\\) ORDER BY n.created_at DESC, n.id DESC LIMIT \\$4").
+		WithArgs("user-1", cursor.Value, cursor.ID, 3).
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow("6ba7b810-9dad-41d1-80b4-00c04fd430c8", "Stars", "", "Fusion", now.Add(-2*time.Hour), now, "[]", "{}", nil))
+
+	req = httptest.NewRequest("GET", "/api/notes?limit=2&cursor="+resp.Header.Get("X-Next-Cursor"), nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Next-Cursor"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotes_Filters(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes", withUser("user-1"), getNotes)
+
+	from := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	filter := regexp.QuoteMeta("WHERE n.user_id = $1 AND EXISTS (SELECT 1 FROM tags t WHERE t.note_id = n.id AND t.tag = $2) " +
+		"AND n.created_at >= $3 AND n.created_at < $4 AND EXISTS (SELECT 1 FROM audio_notes a WHERE a.note_id = n.id)")
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n "+filter).
+		WithArgs("user-1", "biology", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT n.id, COALESCE\\(n.title, ''\\), n.content, .* "+filter+regexp.QuoteMeta(" ORDER BY n.title ASC, n.id ASC")).
+		WithArgs("user-1", "biology", from, to, 51).
+		WillReturnRows(sqlmock.NewRows(noteColumns))
+
+	req := httptest.NewRequest("GET", "/api/notes?tag=biology&from=2024-09-01&to=2024-09-30&source=audio&sort=title&limit=50&fields=content", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("X-Total-Count"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotes_EmptyTitle(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes", withUser("user-1"), getNotes)
+
+	// An untitled note has an empty title, which its cursor carries
+	now := time.Now().UTC()
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY n.title ASC, n.id ASC LIMIT $2")).
+		WithArgs("user-1", 2).
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow(testNoteID, "", "", "Energy", now, now, "[]", "{}", nil).
+			AddRow("1b4e28ba-2fa1-41d2-883f-0016d3cca427", "Atoms", "", "Matter", now, now, "[]", "{}", nil))
+
+	req := httptest.NewRequest("GET", "/api/notes?sort=title&limit=1", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cursor, err := decodeNoteCursor(resp.Header.Get("X-Next-Cursor"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, testNoteID, cursor.ID)
+		assert.Equal(t, "", cursor.Value)
+	}
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("AND (n.title, n.id) > ($2, $3) ORDER BY n.title ASC")).
+		WithArgs("user-1", "", testNoteID, 2).
+		WillReturnRows(sqlmock.NewRows(noteColumns).
+			AddRow("1b4e28ba-2fa1-41d2-883f-0016d3cca427", "Atoms", "", "Matter", now, now, "[]", "{}", nil))
+
+	req = httptest.NewRequest("GET", "/api/notes?sort=title&limit=1&cursor="+resp.Header.Get("X-Next-Cursor"), nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Next-Cursor"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotes_InvalidQuery(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes", withUser("user-1"), getNotes)
+
+	otherSort := noteCursor{Sort: "title", Value: "Cells", ID: testNoteID}.encode()
+	for _, query := range []string{
+		"limit=0",
+		"limit=1000",
+		"sort=content",
+		"cursor=garbage",
+		"cursor=" + otherSort,
+		"from=yesterday",
+		"from=2024-10-01&to=2024-09-01",
+		"source=video",
+		"fields=password",
+	} {
+		req := httptest.NewRequest("GET", "/api/notes?"+query, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNotes_TagFilter(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes", withUser("user-1"), getNotes)
+
+	// Every tag listed must be on the note
+	filter := regexp.QuoteMeta("WHERE n.user_id = $1 AND EXISTS (SELECT 1 FROM tags t WHERE t.note_id = n.id AND t.tag = $2) " +
+		"AND EXISTS (SELECT 1 FROM tags t WHERE t.note_id = n.id AND t.tag = $3)")
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM notes n "+filter).
+		WithArgs("user-1", "cell biology", "exam").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(filter).
+		WithArgs("user-1", "cell biology", "exam", defaultNotePageSize+1).
+		WillReturnRows(sqlmock.NewRows(noteColumns))
+
+	req := httptest.NewRequest("GET", "/api/notes?tag=Cell%20Biology,exam", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateCookieName = "nn_oidc"
+	oidcStateCookiePath = "/auth/oidc"
+	oidcStateTokenType  = "oidc_state"
+	oidcStateExpiry     = 10 * time.Minute
+)
+
+var (
+	errUnverifiedEmail = errors.New("email not verified by the identity provider")
+	errAccountDisabled = errors.New("account disabled")
+)
+
+// oidcStateClaims carry a login attempt from start to callback in a signed
+// cookie, binding the callback to the browser that started it
+type oidcStateClaims struct {
+	TokenType string `json:"token_type"`
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func oidcStart(c *fiber.Ctx) error {
+	provider, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown provider",
+		})
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := generateOpaqueToken()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to start sign-in",
+			})
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := provider.authCodeURL(c.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("[ERROR] OIDC provider %s: %v", provider.Name, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider unavailable",
+		})
+	}
+
+	expiresAt := time.Now().Add(oidcStateExpiry)
+	cookie, err := signingKeys.sign(oidcStateClaims{
+		TokenType: oidcStateTokenType,
+		Provider:  provider.Name,
+		State:     state,
+		Nonce:     nonce,
+		Verifier:  verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign-in",
+		})
+	}
+
+	// Lax, so the cookie comes back on the provider's redirect
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    cookie,
+		Path:     oidcStateCookiePath,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Lax",
+		MaxAge:   int(oidcStateExpiry.Seconds()),
+	})
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+func oidcCallback(c *fiber.Ctx) error {
+	provider, ok := oidcProviders[c.Params("provider")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown provider",
+		})
+	}
+
+	// The state cookie is single-use
+	stateCookie := c.Cookies(oidcStateCookieName)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     oidcStateCookiePath,
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Lax",
+		MaxAge:   -1,
+	})
+
+	if c.Query("error") != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Sign-in was not completed",
+		})
+	}
+
+	attempt := &oidcStateClaims{}
+	parsed, err := jwt.ParseWithClaims(stateCookie, attempt, signingKeys.keyfunc)
+	if err != nil || !parsed.Valid ||
+		attempt.TokenType != oidcStateTokenType ||
+		attempt.Provider != provider.Name ||
+		subtle.ConstantTimeCompare([]byte(attempt.State), []byte(c.Query("state"))) != 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid sign-in state",
+		})
+	}
+	code := c.Query("code")
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing authorization code",
+		})
+	}
+
+	claims, err := provider.exchange(c.Context(), code, attempt.Verifier, attempt.Nonce)
+	if err != nil {
+		log.Printf("[ERROR] OIDC provider %s: %v", provider.Name, err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Sign-in failed",
+		})
+	}
+
+	userID, twoFactor, err := linkOIDCIdentity(provider.Name, claims)
+	if err == errUnverifiedEmail {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The identity provider has not verified this email",
+		})
+	}
+	if err == errAccountDisabled {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account disabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account",
+		})
+	}
+
+	// Same outcome as a password login, carried by cookies
+	if twoFactor {
+		if _, err := startPartialSession(c, userID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create session",
+			})
+		}
+		return c.Redirect(appBaseURL()+"/login/2fa", fiber.StatusFound)
+	}
+	if _, err := startSession(c, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create session",
+		})
+	}
+	return c.Redirect(appBaseURL()+"/", fiber.StatusFound)
+}
+
+// linkOIDCIdentity returns the user for a provider identity. A new identity
+// is linked to the account with the same verified email, or to a new
+// account without a password.
+func linkOIDCIdentity(provider string, claims *IDTokenClaims) (string, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var twoFactor, disabled bool
+	err = tx.QueryRow(`
+		SELECT u.id, u.totp_enabled_at IS NOT NULL, u.disabled_at IS NOT NULL
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2
+	`, provider, claims.Subject).Scan(&userID, &twoFactor, &disabled)
+	if err == nil && disabled {
+		return "", false, errAccountDisabled
+	}
+	if err == nil {
+		return userID, twoFactor, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", false, err
+	}
+
+	// Only a verified email may claim an existing account
+	email := normalizeEmail(claims.Email)
+	if !claims.EmailVerified || validateEmail(email) != "" {
+		return "", false, errUnverifiedEmail
+	}
+
+	err = tx.QueryRow(
+		"SELECT id, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users WHERE email = $1",
+		email,
+	).Scan(&userID, &twoFactor, &disabled)
+	switch {
+	case err == nil && disabled:
+		return "", false, errAccountDisabled
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow(
+			"INSERT INTO users (email, hashed_password, email_verified_at) VALUES ($1, '', NOW()) RETURNING id",
+			email,
+		).Scan(&userID)
+	case err == nil:
+		_, err = tx.Exec(
+			"UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $1",
+			userID,
+		)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		userID,
+		provider,
+		claims.Subject,
+		email,
+	)
+	if err != nil {
+		return "", false, err
+	}
+
+	return userID, twoFactor, tx.Commit()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupOIDCTestApp(t *testing.T) (*fiber.App, sqlmock.Sqlmock, *mockOIDCServer) {
+	t.Helper()
+	app, mock := setupTestApp()
+	t.Cleanup(func() { db.Close() })
+	t.Setenv("APP_BASE_URL", "https://app.neuronote.test")
+
+	server := newMockOIDCServer(t)
+	oidcProviders = map[string]*OIDCProvider{"university": server.provider()}
+	t.Cleanup(func() { oidcProviders = map[string]*OIDCProvider{} })
+
+	app.Get("/auth/oidc/:provider/start", oidcStart)
+	app.Get("/auth/oidc/:provider/callback", oidcCallback)
+	return app, mock, server
+}
+
+// authorizeAtProvider starts a login and lets the mock provider approve it,
+// returning the callback request the browser would make
+func authorizeAtProvider(t *testing.T, app *fiber.App) *http.Request {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/auth/oidc/university/start", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	stateCookie := findCookie(resp, oidcStateCookieName)
+	if !assert.NotNil(t, stateCookie) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.SameSiteLaxMode, stateCookie.SameSite)
+
+	authorize, err := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+	assert.NoError(t, err)
+	assert.Equal(t, "S256", authorize.Query().Get("code_challenge_method"))
+	assert.Equal(t, "openid email", authorize.Query().Get("scope"))
+
+	// The provider redirects back to the gateway
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	providerResp, err := client.Get(authorize.String())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, providerResp.StatusCode)
+	callback, err := url.Parse(providerResp.Header.Get("Location"))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", callback.Path+"?"+callback.RawQuery, nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+	return req
+}
+
+func TestOIDCLogin_CreatesUser(t *testing.T) {
+	app, mock, _ := setupOIDCTestApp(t)
+	callback := authorizeAtProvider(t, app)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.id, u.totp_enabled_at IS NOT NULL, u.disabled_at IS NOT NULL FROM user_identities").
+		WithArgs("university", "subject-123").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users WHERE email = \\$1").
+		WithArgs("ada@uni.example").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO users \\(email, hashed_password, email_verified_at\\)").
+		WithArgs("ada@uni.example").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+	mock.ExpectExec("INSERT INTO user_identities").
+		WithArgs("user-1", "university", "subject-123", "ada@uni.example").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO sessions").
+		WithArgs("user-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://app.neuronote.test/", resp.Header.Get(fiber.HeaderLocation))
+	assert.NotNil(t, findCookie(resp, cookieName))
+	assert.NotNil(t, findCookie(resp, refreshCookieName))
+	if stateCookie := findCookie(resp, oidcStateCookieName); assert.NotNil(t, stateCookie) {
+		assert.Empty(t, stateCookie.Value)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCLogin_LinksExistingAccount(t *testing.T) {
+	app, mock, _ := setupOIDCTestApp(t)
+	callback := authorizeAtProvider(t, app)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.id, u.totp_enabled_at IS NOT NULL, u.disabled_at IS NOT NULL FROM user_identities").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users WHERE email = \\$1").
+		WithArgs("ada@uni.example").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "totp", "disabled"}).AddRow("user-1", false, false))
+	mock.ExpectExec("UPDATE users SET email_verified_at = COALESCE").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_identities").
+		WithArgs("user-1", "university", "subject-123", "ada@uni.example").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO sessions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCLogin_KnownIdentityWithTwoFactor(t *testing.T) {
+	app, mock, _ := setupOIDCTestApp(t)
+	callback := authorizeAtProvider(t, app)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.id, u.totp_enabled_at IS NOT NULL, u.disabled_at IS NOT NULL FROM user_identities").
+		WithArgs("university", "subject-123").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "totp", "disabled"}).AddRow("user-1", true, false))
+	mock.ExpectRollback()
+	mock.ExpectExec("INSERT INTO sessions \\(user_id, token_hash, refresh_token_hash, family_id, expires_at, user_agent, mfa_pending\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://app.neuronote.test/login/2fa", resp.Header.Get(fiber.HeaderLocation))
+	assert.Nil(t, findCookie(resp, refreshCookieName))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCLogin_UnverifiedEmail(t *testing.T) {
+	app, mock, server := setupOIDCTestApp(t)
+	server.EmailVerified = false
+	callback := authorizeAtProvider(t, app)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.id, u.totp_enabled_at IS NOT NULL, u.disabled_at IS NOT NULL FROM user_identities").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCCallback_StateMismatch(t *testing.T) {
+	app, mock, _ := setupOIDCTestApp(t)
+	callback := authorizeAtProvider(t, app)
+
+	// A callback from another login attempt
+	query := callback.URL.Query()
+	query.Set("state", "someone-elses-state")
+	callback.URL.RawQuery = query.Encode()
+	callback.RequestURI = callback.URL.RequestURI()
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCCallback_MissingStateCookie(t *testing.T) {
+	app, mock, _ := setupOIDCTestApp(t)
+	callback := authorizeAtProvider(t, app)
+	callback.Header.Del("Cookie")
+
+	resp, err := app.Test(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCStart_UnknownProvider(t *testing.T) {
+	app, _, _ := setupOIDCTestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/auth/oidc/elsewhere/start", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
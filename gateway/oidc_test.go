@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockOIDCServer is a minimal OpenID provider: discovery, an authorize
+// endpoint that approves immediately, a PKCE-checking token endpoint and
+// a JWKS
+type mockOIDCServer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	clientID string
+	secret   string
+
+	// Identity returned in ID tokens
+	Subject       string
+	Email         string
+	EmailVerified bool
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	m := &mockOIDCServer{
+		key:           key,
+		kid:           "mock-key-1",
+		clientID:      "neuronote",
+		secret:        "client-secret",
+		Subject:       "subject-123",
+		Email:         "Ada@Uni.example",
+		EmailVerified: true,
+		grants:        map[string]mockGrant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != m.clientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + q.Get("state")[:8]
+		m.mu.Lock()
+		m.grants[code] = mockGrant{q.Get("code_challenge"), q.Get("nonce"), q.Get("redirect_uri")}
+		m.mu.Unlock()
+
+		redirect, _ := url.Parse(q.Get("redirect_uri"))
+		params := redirect.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		redirect.RawQuery = params.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != m.clientID || pass != m.secret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		m.mu.Lock()
+		grant, ok := m.grants[r.PostForm.Get("code")]
+		delete(m.grants, r.PostForm.Get("code"))
+		m.mu.Unlock()
+		if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+			pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge ||
+			r.PostForm.Get("redirect_uri") != grant.redirectURI {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idToken := m.signIDToken(t, jwt.MapClaims{"nonce": grant.nonce})
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "provider-access-token",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": {{
+			Kty: "RSA",
+			Kid: m.kid,
+			Alg: "RS256",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// signIDToken signs an ID token for the configured identity, with
+// overrides applied on top of the defaults
+func (m *mockOIDCServer) signIDToken(t *testing.T, overrides jwt.MapClaims) string {
+	claims := jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            m.clientID,
+		"sub":            m.Subject,
+		"email":          m.Email,
+		"email_verified": m.EmailVerified,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func (m *mockOIDCServer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "university",
+		Issuer:       m.URL,
+		ClientID:     m.clientID,
+		ClientSecret: m.secret,
+		RedirectURL:  "http://gateway.test/auth/oidc/university/callback",
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+func TestLoadOIDCProviders(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "university, uni-alt")
+	t.Setenv("OIDC_UNIVERSITY_ISSUER", "https://login.uni.example/")
+	t.Setenv("OIDC_UNIVERSITY_CLIENT_ID", "neuronote")
+	t.Setenv("OIDC_UNIVERSITY_REDIRECT_URL", "https://api.neuronote.test/auth/oidc/university/callback")
+	t.Setenv("OIDC_UNI_ALT_ISSUER", "https://alt.uni.example")
+	t.Setenv("OIDC_UNI_ALT_CLIENT_ID", "neuronote-alt")
+	t.Setenv("OIDC_UNI_ALT_REDIRECT_URL", "https://api.neuronote.test/auth/oidc/uni-alt/callback")
+	t.Setenv("OIDC_UNI_ALT_SCOPES", "openid email")
+
+	providers, err := loadOIDCProviders()
+	assert.NoError(t, err)
+	assert.Len(t, providers, 2)
+	assert.Equal(t, "https://login.uni.example", providers["university"].Issuer)
+	assert.Equal(t, []string{"openid", "email", "profile"}, providers["university"].Scopes)
+	assert.Equal(t, []string{"openid", "email"}, providers["uni-alt"].Scopes)
+
+	t.Setenv("OIDC_UNI_ALT_CLIENT_ID", "")
+	_, err = loadOIDCProviders()
+	assert.Error(t, err)
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	assert.Equal(t,
+		"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"),
+	)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	server := newMockOIDCServer(t)
+	provider := server.provider()
+	ctx := context.Background()
+
+	claims, err := provider.verifyIDToken(ctx, server.signIDToken(t, jwt.MapClaims{"nonce": "n-1"}), "n-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "subject-123", claims.Subject)
+	assert.Equal(t, "Ada@Uni.example", claims.Email)
+	assert.True(t, claims.EmailVerified)
+
+	tests := []struct {
+		name      string
+		overrides jwt.MapClaims
+	}{
+		{"wrong nonce", jwt.MapClaims{"nonce": "n-2"}},
+		{"wrong audience", jwt.MapClaims{"nonce": "n-1", "aud": "someone-else"}},
+		{"wrong issuer", jwt.MapClaims{"nonce": "n-1", "iss": "https://evil.example"}},
+		{"expired", jwt.MapClaims{"nonce": "n-1", "exp": time.Now().Add(-time.Minute).Unix()}},
+		{"no subject", jwt.MapClaims{"nonce": "n-1", "sub": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := provider.verifyIDToken(ctx, server.signIDToken(t, tt.overrides), "n-1")
+			assert.Error(t, err)
+		})
+	}
+
+	// exp is required
+	_, err = provider.verifyIDToken(ctx, signWithout(t, server, "exp", "n-1"), "n-1")
+	assert.Error(t, err)
+}
+
+// signWithout signs an otherwise valid ID token that lacks a claim
+func signWithout(t *testing.T, server *mockOIDCServer, claim, nonce string) string {
+	claims := jwt.MapClaims{
+		"iss":   server.URL,
+		"aud":   server.clientID,
+		"sub":   server.Subject,
+		"nonce": nonce,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	delete(claims, claim)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = server.kid
+	signed, err := token.SignedString(server.key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestVerifyIDToken_RejectsOtherKeys(t *testing.T) {
+	server := newMockOIDCServer(t)
+	provider := server.provider()
+
+	// Signed by a key the provider does not publish
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": server.URL, "aud": server.clientID, "sub": "subject-123",
+		"nonce": "n-1", "exp": time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = server.kid
+	forged, err := token.SignedString(other)
+	assert.NoError(t, err)
+	_, err = provider.verifyIDToken(context.Background(), forged, "n-1")
+	assert.Error(t, err)
+
+	// HS256 with the public modulus as secret must not pass either
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": server.URL, "aud": server.clientID, "sub": "subject-123",
+		"nonce": "n-1", "exp": time.Now().Add(time.Minute).Unix(),
+	})
+	hs.Header["kid"] = server.kid
+	forged, err = hs.SignedString(server.key.N.Bytes())
+	assert.NoError(t, err)
+	_, err = provider.verifyIDToken(context.Background(), forged, "n-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the tus protocol's shape: the client declares
+// the file, sends it in any number of PATCH requests that each start at
+// the offset the server has, asks for that offset with HEAD after a
+// failure, and completes the upload to queue it like POST /api/notes.
+const (
+	uploadOffsetHeader = "Upload-Offset"
+	uploadLengthHeader = "Upload-Length"
+	// PATCH bodies are raw bytes of the file
+	uploadChunkContentType = "application/offset+octet-stream"
+
+	maxUploadFilenameLength = 255
+	// An upload not sent to for this long is given up and removed
+	uploadExpiry = 24 * time.Hour
+	// How often uploads past their expiry are removed
+	uploadSweepInterval = time.Hour
+	// A PATCH holds its upload for at most this long. A chunk still
+	// arriving then is cut off and the client resumes from the offset.
+	uploadClaim = 10 * time.Minute
+	// The claim expires by Postgres's clock and the chunk is cut off by the
+	// gateway's, so the gateway stops this much early to allow for skew
+	uploadClaimMargin = time.Minute
+)
+
+// errUploadClaimExpired stops a chunk that outlives its claim on the upload
+var errUploadClaimExpired = errors.New("upload claim expired")
+
+// ResumableUpload is a file being sent in chunks
+type ResumableUpload struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Offset      int64     `json:"offset"`
+	NotebookID  *string   `json:"notebook_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type CreateUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	NotebookID  string `json:"notebook_id"`
+}
+
+func uploadNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Upload not found",
+	})
+}
+
+func uploadBusy(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": "Another request is sending to this upload",
+	})
+}
+
+// removeExpiredUploads drops every user's abandoned uploads and their
+// files. An upload a chunk is still being written to is left for the next
+// sweep. The rows are gone once the query returns, so a file that cannot
+// be removed is logged and the rest are still removed.
+func removeExpiredUploads() error {
+	rows, err := db.Query(`
+		DELETE FROM uploads
+		WHERE expires_at <= NOW() AND (claimed_until IS NULL OR claimed_until <= NOW())
+		RETURNING user_id, id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var errs []error
+	for rows.Next() {
+		var userID, id string
+		if err := rows.Scan(&userID, &id); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := removeUpload(userID, id); err != nil {
+			log.Printf("[ERROR] Failed to remove expired upload %s: %v", id, err)
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, rows.Err())
+	return errors.Join(errs...)
+}
+
+// sweepExpiredUploads removes expired uploads now and then every
+// uploadSweepInterval until ctx is done
+func sweepExpiredUploads(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := removeExpiredUploads(); err != nil {
+			log.Printf("[ERROR] Failed to remove expired uploads: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// createUpload declares a file that will be sent in chunks. Its bytes are
+// staged under the upload id, which becomes the job id.
+func createUpload(c *fiber.Ctx) error {
+	var req CreateUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	errs := FieldErrors{}
+	req.Filename = filepath.Base(strings.TrimSpace(req.Filename))
+	switch {
+	case req.Filename == "" || req.Filename == "." || req.Filename == string(filepath.Separator):
+		errs["filename"] = "Filename is required"
+	case len(req.Filename) > maxUploadFilenameLength:
+		errs["filename"] = fmt.Sprintf("Filename must be at most %d characters", maxUploadFilenameLength)
+	}
+	if req.SizeBytes <= 0 {
+		errs["size_bytes"] = "Size must be positive"
+	}
+	if len(errs) > 0 {
+		return validationError(c, errs)
+	}
+	if req.SizeBytes > maxUploadBytes {
+		return uploadTooLarge(c)
+	}
+	if req.ContentType == "" {
+		req.ContentType = "application/octet-stream"
+	}
+
+	userID := currentUserID(c)
+	if req.NotebookID != "" {
+		owned, err := ownsNotebook(userID, req.NotebookID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get notebook",
+			})
+		}
+		if !owned {
+			return validationError(c, FieldErrors{"notebook_id": "Notebook not found"})
+		}
+	}
+
+	uploadID := uuid.New().String()
+	path := uploadPath(userID, uploadID)
+	if err := stageEmptyUpload(path); err != nil {
+		log.Printf("[ERROR] Failed to stage upload: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store upload",
+		})
+	}
+
+	var notebook interface{}
+	if req.NotebookID != "" {
+		notebook = req.NotebookID
+	}
+	upload := ResumableUpload{
+		ID:          uploadID,
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		SizeBytes:   req.SizeBytes,
+	}
+	if req.NotebookID != "" {
+		upload.NotebookID = &req.NotebookID
+	}
+	err := db.QueryRow(`
+		INSERT INTO uploads (id, user_id, notebook_id, filename, content_type, size_bytes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + make_interval(secs => $7))
+		RETURNING created_at, expires_at
+	`, uploadID, userID, notebook, req.Filename, req.ContentType, req.SizeBytes, uploadExpiry.Seconds()).
+		Scan(&upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		os.Remove(path)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create upload",
+		})
+	}
+
+	c.Location("/api/uploads/" + uploadID)
+	c.Set(uploadOffsetHeader, "0")
+	c.Set(uploadLengthHeader, strconv.FormatInt(req.SizeBytes, 10))
+	return c.Status(fiber.StatusCreated).JSON(upload)
+}
+
+// stageEmptyUpload creates the file chunks are appended to
+func stageEmptyUpload(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// headUpload tells a client resuming an upload where to continue from
+func headUpload(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if !validNoteID(uploadID) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	var offset, size int64
+	err := db.QueryRow(
+		"SELECT offset_bytes, size_bytes FROM uploads WHERE id = $1 AND user_id = $2 AND expires_at > NOW()",
+		uploadID,
+		currentUserID(c),
+	).Scan(&offset, &size)
+	if err == sql.ErrNoRows {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	c.Set(uploadLengthHeader, strconv.FormatInt(size, 10))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// patchUpload appends a chunk at the upload's offset. Whatever arrives is
+// kept even if the connection drops, so the client resumes from the offset
+// HEAD reports rather than resending the chunk.
+func patchUpload(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if !validNoteID(uploadID) {
+		return uploadNotFound(c)
+	}
+	if c.Get(fiber.HeaderContentType) != uploadChunkContentType {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be " + uploadChunkContentType,
+		})
+	}
+	offset, err := strconv.ParseInt(c.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return validationError(c, FieldErrors{"upload_offset": "Upload-Offset must be a byte offset"})
+	}
+
+	// The upload is claimed for the chunk so chunks cannot interleave. No
+	// transaction is held open while the body streams in.
+	userID := currentUserID(c)
+	claim := uuid.New().String()
+	deadline := time.Now().Add(uploadClaim - uploadClaimMargin)
+	var size int64
+	err = db.QueryRow(`
+		UPDATE uploads SET claim_token = $4, claimed_until = NOW() + make_interval(secs => $5)
+		WHERE id = $1 AND user_id = $2 AND expires_at > NOW() AND offset_bytes = $3
+			AND (claimed_until IS NULL OR claimed_until <= NOW())
+		RETURNING size_bytes
+	`, uploadID, userID, offset, claim, uploadClaim.Seconds()).Scan(&size)
+	if err == sql.ErrNoRows {
+		return uploadNotClaimed(c, uploadID, userID, offset)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update upload",
+		})
+	}
+
+	var written int64
+	var writeErr error
+	if int64(c.Request().Header.ContentLength()) > size-offset {
+		writeErr = errUploadTooLarge
+	} else {
+		body := &claimedReader{r: requestBody(c, size-offset), deadline: deadline}
+		written, writeErr = appendUpload(uploadPath(userID, uploadID), offset, body)
+	}
+
+	// Saving the offset releases the claim. A claim that ran out by the
+	// database's clock saves nothing, and the next chunk overwrites what
+	// was written past the offset.
+	result, err := db.Exec(`
+		UPDATE uploads SET offset_bytes = $3, claim_token = NULL, claimed_until = NULL,
+			expires_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+		WHERE id = $1 AND claim_token = $2 AND claimed_until > NOW()
+	`, uploadID, claim, offset+written, uploadExpiry.Seconds())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update upload",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Deleted, or the claim ran out
+		return uploadBusy(c)
+	}
+	c.Set(uploadOffsetHeader, strconv.FormatInt(offset+written, 10))
+
+	var pathErr *os.PathError
+	switch {
+	case writeErr == nil:
+		return c.SendStatus(fiber.StatusNoContent)
+	case errors.Is(writeErr, errUploadTooLarge):
+		return uploadTooLarge(c)
+	case errors.Is(writeErr, errUploadClaimExpired):
+		return c.Status(fiber.StatusRequestTimeout).JSON(fiber.Map{
+			"error": "Chunk took too long, resume from Upload-Offset",
+		})
+	case errors.As(writeErr, &pathErr):
+		log.Printf("[ERROR] Failed to write upload %s: %v", uploadID, writeErr)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store upload",
+		})
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read chunk",
+		})
+	}
+}
+
+// uploadNotClaimed explains why a PATCH could not claim the upload
+func uploadNotClaimed(c *fiber.Ctx, uploadID, userID string, offset int64) error {
+	var current int64
+	var claimed bool
+	err := db.QueryRow(`
+		SELECT offset_bytes, COALESCE(claimed_until > NOW(), FALSE) FROM uploads
+		WHERE id = $1 AND user_id = $2 AND expires_at > NOW()
+	`, uploadID, userID).Scan(&current, &claimed)
+	if err == sql.ErrNoRows {
+		return uploadNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update upload",
+		})
+	}
+	if claimed || current == offset {
+		return uploadBusy(c)
+	}
+	c.Set(uploadOffsetHeader, strconv.FormatInt(current, 10))
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":  "Upload-Offset does not match the upload",
+		"offset": current,
+	})
+}
+
+// claimedReader fails with errUploadClaimExpired once the claim's deadline
+// passes. The deadline is taken before the claim is made and short of it by
+// uploadClaimMargin, so nothing read after it is written while another
+// request could hold the upload.
+type claimedReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (r *claimedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if time.Now().After(r.deadline) {
+		return 0, errUploadClaimExpired
+	}
+	return n, err
+}
+
+// appendUpload writes r to the staged file from offset, dropping anything
+// past offset that was never recorded. The bytes are synced before the
+// offset is.
+func appendUpload(path string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if syncErr := f.Sync(); syncErr != nil {
+		return 0, syncErr
+	}
+	return n, err
+}
+
+// completeUpload queues a fully sent upload for the ML service, as
+// POST /api/notes does with a file sent at once
+func completeUpload(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if !validNoteID(uploadID) {
+		return uploadNotFound(c)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue upload",
+		})
+	}
+	defer tx.Rollback()
+
+	userID := currentUserID(c)
+	var upload ResumableUpload
+	var notebookID sql.NullString
+	// A second completion waits for the first and then finds the upload
+	// gone. Chunks never hold the row, they claim it.
+	err = tx.QueryRow(`
+		SELECT filename, content_type, size_bytes, offset_bytes, notebook_id FROM uploads
+		WHERE id = $1 AND user_id = $2 AND expires_at > NOW()
+		FOR UPDATE
+	`, uploadID, userID).Scan(&upload.Filename, &upload.ContentType, &upload.SizeBytes, &upload.Offset, &notebookID)
+	if err == sql.ErrNoRows {
+		return uploadNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue upload",
+		})
+	}
+	if upload.Offset < upload.SizeBytes {
+		c.Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Upload is not complete",
+			"offset": upload.Offset,
+		})
+	}
+
+	// The upload becomes a job under the same id, so its file stays put
+	if _, err := tx.Exec("DELETE FROM uploads WHERE id = $1", uploadID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue upload",
+		})
+	}
+	job, err := enqueueJob(tx, uploadID, userID, notebookID.String, upload.Filename, upload.ContentType, upload.SizeBytes)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to queue upload %s: %v", uploadID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to queue upload",
+		})
+	}
+	wakeJobWorker()
+	log.Printf("[INFO] Queued resumable upload %s (%d bytes)", upload.Filename, upload.SizeBytes)
+
+	c.Location("/api/jobs/" + job.ID)
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// deleteUpload abandons an upload and removes what was sent of it
+func deleteUpload(c *fiber.Ctx) error {
+	uploadID := c.Params("id")
+	if !validNoteID(uploadID) {
+		return uploadNotFound(c)
+	}
+
+	userID := currentUserID(c)
+	result, err := db.Exec("DELETE FROM uploads WHERE id = $1 AND user_id = $2", uploadID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete upload",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return uploadNotFound(c)
+	}
+	if err := removeUpload(userID, uploadID); err != nil {
+		log.Printf("[ERROR] Failed to remove upload %s: %v", uploadID, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
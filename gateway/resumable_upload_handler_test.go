@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUploadID = "7c1e4b2a-3d5f-4a6b-8c9d-0e1f2a3b4c5d"
+
+func setupUploadApp(t *testing.T) (*fiber.App, sqlmock.Sqlmock) {
+	app := newStreamingApp()
+	_, mock := setupTestApp()
+	t.Cleanup(func() { db.Close() })
+	uploadDir = t.TempDir()
+	app.Post("/api/uploads", withUser("user-1"), createUpload)
+	app.Head("/api/uploads/:id", withUser("user-1"), headUpload)
+	app.Patch("/api/uploads/:id", withUser("user-1"), patchUpload)
+	app.Post("/api/uploads/:id/complete", withUser("user-1"), completeUpload)
+	app.Delete("/api/uploads/:id", withUser("user-1"), deleteUpload)
+	return app, mock
+}
+
+// stageChunks writes what earlier chunks left on disk
+func stageChunks(t *testing.T, data string) {
+	assert.NoError(t, stageEmptyUpload(uploadPath("user-1", testUploadID)))
+	assert.NoError(t, os.WriteFile(uploadPath("user-1", testUploadID), []byte(data), 0o600))
+}
+
+func expectUploadClaim(mock sqlmock.Sqlmock, offset, size int64) {
+	mock.ExpectQuery("UPDATE uploads SET claim_token = \\$4").
+		WithArgs(testUploadID, "user-1", offset, sqlmock.AnyArg(), uploadClaim.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"size_bytes"}).AddRow(size))
+}
+
+func expectUploadRelease(mock sqlmock.Sqlmock, offset int64) *sqlmock.ExpectedExec {
+	return mock.ExpectExec("UPDATE uploads SET offset_bytes = \\$3, claim_token = NULL.*AND claimed_until > NOW\\(\\)").
+		WithArgs(testUploadID, sqlmock.AnyArg(), offset, uploadExpiry.Seconds())
+}
+
+// expectUploadUnclaimed has the claim fail and the upload looked up to
+// say why
+func expectUploadUnclaimed(mock sqlmock.Sqlmock, offset int64, claimed bool) {
+	mock.ExpectQuery("UPDATE uploads SET claim_token").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT offset_bytes, COALESCE\\(claimed_until > NOW\\(\\), FALSE\\) FROM uploads").
+		WithArgs(testUploadID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"offset_bytes", "claimed"}).AddRow(offset, claimed))
+}
+
+func patchChunk(app *fiber.App, offset, body string) (*http.Response, error) {
+	req := httptest.NewRequest("PATCH", "/api/uploads/"+testUploadID, strings.NewReader(body))
+	req.Header.Set("Content-Type", uploadChunkContentType)
+	req.Header.Set("Upload-Offset", offset)
+	return app.Test(req)
+}
+
+func TestCreateUpload(t *testing.T) {
+	app, mock := setupUploadApp(t)
+
+	expectNotebookOwned(mock, "user-1", true)
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO uploads").
+		WithArgs(sqlmock.AnyArg(), "user-1", testNotebookID, "lecture 5.mp3", "audio/mpeg", int64(500<<20), uploadExpiry.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "expires_at"}).AddRow(now, now.Add(uploadExpiry)))
+
+	body := `{"filename":"../lecture 5.mp3","content_type":"audio/mpeg","size_bytes":524288000,"notebook_id":"` + testNotebookID + `"}`
+	req := httptest.NewRequest("POST", "/api/uploads", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Upload-Offset"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var upload ResumableUpload
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+	assert.Equal(t, "/api/uploads/"+upload.ID, resp.Header.Get("Location"))
+	assert.Equal(t, "lecture 5.mp3", upload.Filename)
+
+	// An empty file waits for the chunks
+	info, err := os.Stat(uploadPath("user-1", upload.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestCreateUpload_Invalid(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	limitUploads(t, 1<<20)
+
+	for body, status := range map[string]int{
+		`{"filename":"","size_bytes":10}`:           http.StatusBadRequest,
+		`{"filename":"a.mp3","size_bytes":0}`:       http.StatusBadRequest,
+		`{"filename":"a.mp3","size_bytes":2097152}`: http.StatusRequestEntityTooLarge,
+	} {
+		req := httptest.NewRequest("POST", "/api/uploads", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, status, resp.StatusCode, body)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHeadUpload(t *testing.T) {
+	app, mock := setupUploadApp(t)
+
+	mock.ExpectQuery("SELECT offset_bytes, size_bytes FROM uploads WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testUploadID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"offset_bytes", "size_bytes"}).AddRow(4096, 10240))
+	mock.ExpectQuery("SELECT offset_bytes, size_bytes FROM uploads WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testUploadID, "user-1").
+		WillReturnError(sql.ErrNoRows)
+
+	resp, err := app.Test(httptest.NewRequest("HEAD", "/api/uploads/"+testUploadID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "4096", resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, "10240", resp.Header.Get("Upload-Length"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// Someone else's or an expired upload
+	resp, err = app.Test(httptest.NewRequest("HEAD", "/api/uploads/"+testUploadID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSweepExpiredUploads(t *testing.T) {
+	_, mock := setupUploadApp(t)
+	stageChunks(t, "Cells")
+	other := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	assert.NoError(t, stageEmptyUpload(uploadPath("user-2", other)))
+
+	// Every user's expired uploads go, not only the next uploader's
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM uploads WHERE expires_at <= NOW() AND (claimed_until IS NULL OR claimed_until <= NOW())")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "id"}).
+			AddRow("user-1", testUploadID).
+			AddRow("user-2", other))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sweepExpiredUploads(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	for _, path := range []string{uploadPath("user-1", testUploadID), uploadPath("user-2", other)} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestRemoveExpiredUploads_KeepsGoing(t *testing.T) {
+	_, mock := setupUploadApp(t)
+	other := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	assert.NoError(t, stageEmptyUpload(uploadPath("user-2", other)))
+	// A path that cannot be removed, standing in for a failing disk
+	stuck := uploadPath("user-1", testUploadID)
+	assert.NoError(t, os.MkdirAll(filepath.Join(stuck, "busy"), 0o700))
+
+	mock.ExpectQuery("DELETE FROM uploads WHERE expires_at <= NOW\\(\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "id"}).
+			AddRow("user-1", testUploadID).
+			AddRow("user-2", other))
+
+	// The rows are already gone, so the files after a failure still go
+	assert.Error(t, removeExpiredUploads())
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_, err := os.Stat(uploadPath("user-2", other))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPatchUpload(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	// Bytes past the recorded offset are from a chunk that was cut off
+	stageChunks(t, "Cells divXX")
+
+	expectUploadClaim(mock, 9, 20)
+	expectUploadRelease(mock, 15).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := patchChunk(app, "9", "ide by")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "15", resp.Header.Get("Upload-Offset"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	data, err := os.ReadFile(uploadPath("user-1", testUploadID))
+	assert.NoError(t, err)
+	assert.Equal(t, "Cells divide by", string(data))
+}
+
+func TestPatchUpload_Conflicts(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	stageChunks(t, "Cells")
+
+	// A chunk for the wrong offset is refused with the right one
+	expectUploadUnclaimed(mock, 5, false)
+	resp, err := patchChunk(app, "0", "Cells")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Upload-Offset"))
+
+	// Another request is still sending
+	expectUploadUnclaimed(mock, 5, true)
+	resp, err = patchChunk(app, "5", " divide")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Upload-Offset"))
+
+	// Someone else's or an expired upload
+	mock.ExpectQuery("UPDATE uploads SET claim_token").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT offset_bytes, COALESCE").
+		WillReturnError(sql.ErrNoRows)
+	resp, err = patchChunk(app, "5", " divide")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// More than was declared, which gives the claim back untouched
+	expectUploadClaim(mock, 5, 8)
+	expectUploadRelease(mock, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	resp, err = patchChunk(app, "5", " divide")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Deleted, or the claim ran out by the database's clock, while the
+	// chunk was being written
+	expectUploadClaim(mock, 5, 20)
+	expectUploadRelease(mock, 12).WillReturnResult(sqlmock.NewResult(0, 0))
+	resp, err = patchChunk(app, "5", " divide")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	os.Truncate(uploadPath("user-1", testUploadID), 5)
+
+	// Chunks must be raw bytes
+	req := httptest.NewRequest("PATCH", "/api/uploads/"+testUploadID, strings.NewReader("x"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Upload-Offset", "5")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	data, err := os.ReadFile(uploadPath("user-1", testUploadID))
+	assert.NoError(t, err)
+	assert.Equal(t, "Cells", string(data))
+}
+
+func TestClaimedReader(t *testing.T) {
+	// Bytes read after the claim ran out are not passed on
+	r := &claimedReader{r: strings.NewReader("Cells"), deadline: time.Now().Add(-time.Second)}
+	n, err := r.Read(make([]byte, 5))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, errUploadClaimExpired)
+
+	r = &claimedReader{r: strings.NewReader("Cells"), deadline: time.Now().Add(time.Minute)}
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "Cells", string(data))
+}
+
+func TestCompleteUpload(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	stageChunks(t, "Cells divide")
+
+	uploadColumns := []string{"filename", "content_type", "size_bytes", "offset_bytes", "notebook_id"}
+
+	// Not everything has arrived yet
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM uploads.*FOR UPDATE").
+		WithArgs(testUploadID, "user-1").
+		WillReturnRows(sqlmock.NewRows(uploadColumns).AddRow("lecture.mp3", "audio/mpeg", 20, 12, nil))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("POST", "/api/uploads/"+testUploadID+"/complete", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "12", resp.Header.Get("Upload-Offset"))
+
+	// The finished upload becomes a job with the same id
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM uploads.*FOR UPDATE").
+		WithArgs(testUploadID, "user-1").
+		WillReturnRows(sqlmock.NewRows(uploadColumns).AddRow("lecture.mp3", "audio/mpeg", 12, 12, testNotebookID))
+	mock.ExpectExec("DELETE FROM uploads WHERE id = \\$1").
+		WithArgs(testUploadID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO jobs").
+		WithArgs(testUploadID, "user-1", testNotebookID, "lecture.mp3", "audio/mpeg", int64(12)).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(testUploadID, "queued", "", "", "", "lecture.mp3", "audio/mpeg", 12, now, nil, nil))
+	mock.ExpectCommit()
+
+	req = httptest.NewRequest("POST", "/api/uploads/"+testUploadID+"/complete", nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "/api/jobs/"+testUploadID, resp.Header.Get("Location"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// The worker finds the file where it expects a job's upload
+	_, err = os.Stat(uploadPath("user-1", testUploadID))
+	assert.NoError(t, err)
+}
+
+func TestDeleteUpload(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	stageChunks(t, "Cells")
+
+	mock.ExpectExec("DELETE FROM uploads WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testUploadID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM uploads WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(testUploadID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/api/uploads/"+testUploadID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = os.Stat(uploadPath("user-1", testUploadID))
+	assert.True(t, os.IsNotExist(err))
+
+	resp, err = app.Test(httptest.NewRequest("DELETE", "/api/uploads/"+testUploadID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPatchUpload_ChunkPastDeclaredSize(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	stageChunks(t, "Cells")
+
+	// A chunked body has no length to refuse up front, so what fits is
+	// kept and the rest refused
+	expectUploadClaim(mock, 5, 12)
+	expectUploadRelease(mock, 12).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req, err := http.NewRequest("PATCH", serveApp(t, app)+"/api/uploads/"+testUploadID, io.MultiReader(strings.NewReader(" divide and more")))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", uploadChunkContentType)
+	req.Header.Set("Upload-Offset", "5")
+	// An idle keep-alive connection would hold up the server's shutdown
+	req.Close = true
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, "12", resp.Header.Get("Upload-Offset"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	data, err := os.ReadFile(uploadPath("user-1", testUploadID))
+	assert.NoError(t, err)
+	assert.Equal(t, "Cells divide", string(data))
+}
+
+func TestPatchUpload_ConnectionDropped(t *testing.T) {
+	app, mock := setupUploadApp(t)
+	stageChunks(t, "Cells")
+
+	// The client promises more than it sends before the connection goes
+	sent := strings.Repeat("mitosis ", 2000)
+	expectUploadClaim(mock, 5, 100005)
+	expectUploadRelease(mock, int64(5+len(sent))).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serveApp(t, app), "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "PATCH /api/uploads/%s HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Type: %s\r\nUpload-Offset: 5\r\nContent-Length: 100000\r\n\r\n%s",
+		testUploadID, uploadChunkContentType, sent)
+	conn.Close()
+
+	// What arrived is recorded, so HEAD sends the client on from there
+	assert.Eventually(t, func() bool { return mock.ExpectationsWereMet() == nil }, 5*time.Second, 10*time.Millisecond)
+	data, err := os.ReadFile(uploadPath("user-1", testUploadID))
+	assert.NoError(t, err)
+	assert.Equal(t, "Cells"+sent, string(data))
+}
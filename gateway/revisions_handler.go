@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// NoteRevision is a note's title, content and summary as they were after
+// one change. Lists leave out content and summary.
+type NoteRevision struct {
+	Revision  int       `json:"revision"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevisionDiff is a line-level diff of each field between two revisions
+type RevisionDiff struct {
+	From    int        `json:"from"`
+	To      int        `json:"to"`
+	Title   []DiffLine `json:"title"`
+	Content []DiffLine `json:"content"`
+	Summary []DiffLine `json:"summary"`
+}
+
+func revisionNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Revision not found",
+	})
+}
+
+// revisionNumber parses a revision number, which starts at 1
+func revisionNumber(value string) (int, bool) {
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= 1
+}
+
+// loadRevision reads one revision of a note the user owns
+func loadRevision(userID, noteID string, revision int) (NoteRevision, error) {
+	var rev NoteRevision
+	err := db.QueryRow(`
+		SELECT r.revision, COALESCE(r.title, ''), COALESCE(r.content, ''), COALESCE(r.summary, ''), r.created_at
+		FROM note_revisions r
+		JOIN notes n ON n.id = r.note_id
+		WHERE n.id = $1 AND n.user_id = $2 AND r.revision = $3
+	`, noteID, userID, revision).Scan(&rev.Revision, &rev.Title, &rev.Content, &rev.Summary, &rev.CreatedAt)
+	return rev, err
+}
+
+// listNoteRevisions returns a note's history, newest first. Every note has
+// at least the revision it was created with, so none means no such note.
+func listNoteRevisions(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	rows, err := db.Query(`
+		SELECT r.revision, COALESCE(r.title, ''), r.created_at
+		FROM note_revisions r
+		JOIN notes n ON n.id = r.note_id
+		WHERE n.id = $1 AND n.user_id = $2
+		ORDER BY r.revision DESC
+	`, noteID, currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch revisions",
+		})
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		var rev NoteRevision
+		if err := rows.Scan(&rev.Revision, &rev.Title, &rev.CreatedAt); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan revision",
+			})
+		}
+		revisions = append(revisions, rev)
+	}
+	if len(revisions) == 0 {
+		return noteNotFound(c)
+	}
+
+	return c.JSON(revisions)
+}
+
+func getNoteRevision(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	revision, ok := revisionNumber(c.Params("rev"))
+	if !validNoteID(noteID) || !ok {
+		return revisionNotFound(c)
+	}
+
+	rev, err := loadRevision(currentUserID(c), noteID, revision)
+	if err == sql.ErrNoRows {
+		return revisionNotFound(c)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get revision",
+		})
+	}
+	return c.JSON(rev)
+}
+
+// diffNoteRevisions compares the revisions in from and to, which may be in
+// either order
+func diffNoteRevisions(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	errs := FieldErrors{}
+	from, ok := revisionNumber(c.Query("from"))
+	if !ok {
+		errs["from"] = "From must be a revision number"
+	}
+	to, ok := revisionNumber(c.Query("to"))
+	if !ok {
+		errs["to"] = "To must be a revision number"
+	}
+	if len(errs) > 0 {
+		return validationError(c, errs)
+	}
+
+	userID := currentUserID(c)
+	revisions := make([]NoteRevision, 2)
+	for i, revision := range []int{from, to} {
+		rev, err := loadRevision(userID, noteID, revision)
+		if err == sql.ErrNoRows {
+			return revisionNotFound(c)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get revision",
+			})
+		}
+		revisions[i] = rev
+	}
+
+	before, after := revisions[0], revisions[1]
+	return c.JSON(RevisionDiff{
+		From:    from,
+		To:      to,
+		Title:   diffLines(before.Title, after.Title),
+		Content: diffLines(before.Content, after.Content),
+		Summary: diffLines(before.Summary, after.Summary),
+	})
+}
+
+// restoreNoteRevision puts a revision's title, content and summary back.
+// The restore is itself recorded as a new revision, so nothing is lost.
+func restoreNoteRevision(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	revision, ok := revisionNumber(c.Params("rev"))
+	if !validNoteID(noteID) || !ok {
+		return revisionNotFound(c)
+	}
+
+	result, err := db.Exec(`
+		UPDATE notes n SET title = COALESCE(r.title, ''), content = r.content, summary = r.summary
+		FROM note_revisions r
+		WHERE n.id = $1 AND n.user_id = $2 AND r.note_id = n.id AND r.revision = $3
+	`, noteID, currentUserID(c), revision)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to restore revision",
+		})
+	}
+	if restored, _ := result.RowsAffected(); restored == 0 {
+		return revisionNotFound(c)
+	}
+
+	return getNote(c)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var revisionColumns = []string{"revision", "title", "content", "summary", "created_at"}
+
+func TestListNoteRevisions(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id/revisions", withUser("user-1"), listNoteRevisions)
+
+	now := time.Now()
+	mock.ExpectQuery("FROM note_revisions r JOIN notes n ON n.id = r.note_id WHERE n.id = \\$1 AND n.user_id = \\$2 ORDER BY r.revision DESC").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"revision", "title", "created_at"}).
+			AddRow(2, "Cell biology", now).
+			AddRow(1, "", now.Add(-time.Hour)))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var revisions []map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&revisions))
+	if assert.Len(t, revisions, 2) {
+		assert.Equal(t, float64(2), revisions[0]["revision"])
+		assert.NotContains(t, revisions[0], "content")
+	}
+}
+
+func TestListNoteRevisions_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id/revisions", withUser("user-1"), listNoteRevisions)
+
+	// Another user's note has no revisions visible to this one
+	mock.ExpectQuery("FROM note_revisions r").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"revision", "title", "created_at"}))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetNoteRevision(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id/revisions/:rev", withUser("user-1"), getNoteRevision)
+
+	mock.ExpectQuery("FROM note_revisions r JOIN notes n ON n.id = r.note_id WHERE n.id = \\$1 AND n.user_id = \\$2 AND r.revision = \\$3").
+		WithArgs(testNoteID, "user-1", 1).
+		WillReturnRows(sqlmock.NewRows(revisionColumns).AddRow(1, "", "Mitochondria", "Energy from the ML pipeline", time.Now()))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions/1", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var rev NoteRevision
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&rev))
+	assert.Equal(t, "Energy from the ML pipeline", rev.Summary)
+
+	for _, path := range []string{"/api/notes/" + testNoteID + "/revisions/0", "/api/notes/not-a-uuid/revisions/1"} {
+		req := httptest.NewRequest("GET", path, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func TestDiffNoteRevisions(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id/revisions/diff", withUser("user-1"), diffNoteRevisions)
+
+	now := time.Now()
+	mock.ExpectQuery("FROM note_revisions r").
+		WithArgs(testNoteID, "user-1", 1).
+		WillReturnRows(sqlmock.NewRows(revisionColumns).AddRow(1, "Cells", "Mitochondria\nRibosomes", "Energy", now))
+	mock.ExpectQuery("FROM note_revisions r").
+		WithArgs(testNoteID, "user-1", 3).
+		WillReturnRows(sqlmock.NewRows(revisionColumns).AddRow(3, "Cells", "Mitochondria\nNucleus", "Energy", now))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions/diff?from=1&to=3", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var diff RevisionDiff
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&diff))
+	assert.Equal(t, []DiffLine{{Op: "equal", Text: "Cells"}}, diff.Title)
+	assert.Equal(t, []DiffLine{
+		{Op: "equal", Text: "Mitochondria"},
+		{Op: "delete", Text: "Ribosomes"},
+		{Op: "insert", Text: "Nucleus"},
+	}, diff.Content)
+}
+
+func TestDiffNoteRevisions_Rejected(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/notes/:id/revisions/diff", withUser("user-1"), diffNoteRevisions)
+
+	for _, query := range []string{"", "?from=1", "?from=a&to=2", "?from=0&to=1"} {
+		req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions/diff"+query, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	mock.ExpectQuery("FROM note_revisions r").
+		WithArgs(testNoteID, "user-1", 1).
+		WillReturnRows(sqlmock.NewRows(revisionColumns))
+
+	req := httptest.NewRequest("GET", "/api/notes/"+testNoteID+"/revisions/diff?from=1&to=2", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRestoreNoteRevision(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes/:id/revisions/:rev/restore", withUser("user-1"), restoreNoteRevision)
+
+	mock.ExpectExec("UPDATE notes n SET title = COALESCE\\(r.title, ''\\), content = r.content, summary = r.summary FROM note_revisions r").
+		WithArgs(testNoteID, "user-1", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	now := time.Now()
+	mock.ExpectQuery("WHERE n.id = \\$1 AND n.user_id = \\$2").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows(noteColumns).AddRow(testNoteID, "", "Mitochondria", "Energy", now, now, "[]", "{}", nil))
+
+	req := httptest.NewRequest("POST", "/api/notes/"+testNoteID+"/revisions/1/restore", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var note Note
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&note))
+	assert.Equal(t, "Energy", note.Summary)
+}
+
+func TestRestoreNoteRevision_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes/:id/revisions/:rev/restore", withUser("user-1"), restoreNoteRevision)
+
+	mock.ExpectExec("UPDATE notes n SET").
+		WithArgs(testNoteID, "user-1", 9).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest("POST", "/api/notes/"+testNoteID+"/revisions/9/restore", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
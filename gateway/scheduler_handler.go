@@ -7,6 +7,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type CreateScheduleRequest struct {
@@ -43,12 +44,43 @@ func createSchedule(c *fiber.Ctx) error {
 		})
 	}
 
+	// Get user ID from session
+	userID := currentUserID(c)
+
+	// Notes sent without a due date are due on their notebook's exam
+	var undated []string
+	for _, n := range req.Notes {
+		if n.DueDate.IsZero() && validNoteID(n.ID) {
+			undated = append(undated, n.ID)
+		}
+	}
+	examDates := map[string]time.Time{}
+	if len(undated) > 0 {
+		var err error
+		examDates, err = notebookExamDates(userID, undated)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch notebook exam dates",
+			})
+		}
+	}
+
 	// Convert request to solver input
 	notes := make([]scheduler.Note, len(req.Notes))
 	for i, n := range req.Notes {
+		dueDate := n.DueDate
+		if dueDate.IsZero() {
+			examDate, ok := examDates[n.ID]
+			if !ok {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Note " + n.ID + " needs a due date or a notebook with an exam date",
+				})
+			}
+			dueDate = examDate
+		}
 		notes[i] = scheduler.Note{
 			ID:      n.ID,
-			DueDate: n.DueDate,
+			DueDate: dueDate,
 			Weight:  n.Weight,
 		}
 	}
@@ -62,9 +94,6 @@ func createSchedule(c *fiber.Ctx) error {
 		}
 	}
 
-	// Get user ID from context
-	userID := c.Get("X-User-ID")
-
 	// Create solver and generate schedule
 	solver := scheduler.NewSolver(notes, calendar, userID)
 	blocks, err := solver.Solve()
@@ -105,9 +134,35 @@ func createSchedule(c *fiber.Ctx) error {
 	return c.JSON(blocks)
 }
 
+// notebookExamDates maps the user's notes among noteIDs to the exam date of
+// their notebook, for the notes whose notebook has one
+func notebookExamDates(userID string, noteIDs []string) (map[string]time.Time, error) {
+	rows, err := db.Query(`
+		SELECT n.id, b.exam_date
+		FROM notes n
+		JOIN notebooks b ON b.id = n.notebook_id
+		WHERE n.user_id = $1 AND n.id = ANY($2::uuid[]) AND b.exam_date IS NOT NULL
+	`, userID, pq.Array(noteIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dates := map[string]time.Time{}
+	for rows.Next() {
+		var noteID string
+		var examDate time.Time
+		if err := rows.Scan(&noteID, &examDate); err != nil {
+			return nil, err
+		}
+		dates[noteID] = examDate
+	}
+	return dates, rows.Err()
+}
+
 func getStudySchedule(c *fiber.Ctx) error {
-	// Get user ID from context
-	userID := c.Get("X-User-ID")
+	// Get user ID from session
+	userID := currentUserID(c)
 
 	// Get upcoming study blocks
 	rows, err := db.Query(`
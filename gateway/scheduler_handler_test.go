@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,10 +52,13 @@ func TestCreateSchedule(t *testing.T) {
 	}
 
 	// Expect transaction
+	// Two free hours yield the maximum of three 30-minute blocks
 	mock.ExpectBegin()
-	mock.ExpectExec("INSERT INTO study_blocks").
-		WithArgs(sqlmock.AnyArg(), "test-user", "note1", sqlmock.AnyArg(), sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	for i := 0; i < 3; i++ {
+		mock.ExpectExec("INSERT INTO study_blocks").
+			WithArgs(sqlmock.AnyArg(), "test-user", "note1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
 	mock.ExpectCommit()
 
 	// Create request
@@ -61,10 +66,10 @@ func TestCreateSchedule(t *testing.T) {
 	assert.NoError(t, err)
 	request := httptest.NewRequest("POST", "/api/schedule", bytes.NewReader(body))
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("X-User-ID", "test-user")
+	request.Header.Set("X-User-ID", "spoofed-user")
 
 	// Test
-	app.Post("/api/schedule", createSchedule)
+	app.Post("/api/schedule", withUser("test-user"), createSchedule)
 	resp, err := app.Test(request)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -97,10 +102,10 @@ func TestGetStudySchedule(t *testing.T) {
 
 	// Create request
 	request := httptest.NewRequest("GET", "/api/schedule", nil)
-	request.Header.Set("X-User-ID", "test-user")
+	request.Header.Set("X-User-ID", "spoofed-user")
 
 	// Test
-	app.Get("/api/schedule", getStudySchedule)
+	app.Get("/api/schedule", withUser("test-user"), getStudySchedule)
 	resp, err := app.Test(request)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -117,7 +122,7 @@ func TestGetStudySchedule(t *testing.T) {
 
 func TestCreateSchedule_Validation(t *testing.T) {
 	app := fiber.New()
-	app.Post("/api/schedule", createSchedule)
+	app.Post("/api/schedule", withUser("test-user"), createSchedule)
 
 	tests := []struct {
 		name    string
@@ -180,7 +185,6 @@ func TestCreateSchedule_Validation(t *testing.T) {
 
 			req := httptest.NewRequest("POST", "/api/schedule", bytes.NewReader(body))
 			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("X-User-ID", "test-user")
 
 			resp, err := app.Test(req)
 			assert.NoError(t, err)
@@ -193,3 +197,46 @@ func TestCreateSchedule_Validation(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateSchedule_NotebookExamDate(t *testing.T) {
+	app := fiber.New()
+	var mock sqlmock.Sqlmock
+	var err error
+	db, mock, err = sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	app.Post("/api/schedule", withUser("test-user"), createSchedule)
+
+	// The note has no due date of its own
+	now := time.Now()
+	mock.ExpectQuery("JOIN notebooks b ON b.id = n.notebook_id").
+		WithArgs("test-user", pq.Array([]string{testNoteID})).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "exam_date"}).AddRow(testNoteID, now.Add(72*time.Hour)))
+	mock.ExpectBegin()
+	for i := 0; i < 3; i++ {
+		mock.ExpectExec("INSERT INTO study_blocks").
+			WithArgs(sqlmock.AnyArg(), "test-user", testNoteID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	body := `{"notes":[{"id":"` + testNoteID + `","weight":1}],"calendar":[{"start":"` + now.Format(time.RFC3339) + `","end":"` + now.Add(2*time.Hour).Format(time.RFC3339) + `"}]}`
+	request := httptest.NewRequest("POST", "/api/schedule", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Without a notebook exam date there is nothing to schedule against
+	mock.ExpectQuery("JOIN notebooks b ON b.id = n.notebook_id").
+		WithArgs("test-user", pq.Array([]string{testNoteID})).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "exam_date"}))
+
+	request = httptest.NewRequest("POST", "/api/schedule", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 50
+	maxSearchQueryBytes = 256
+
+	// ts_headline marks matches with control characters, which cannot be
+	// confused with note text, and they become <mark> after escaping
+	snippetStart = "\x02"
+	snippetStop  = "\x03"
+)
+
+// SearchHit is a match in a note, one of its quiz cards or its OCR text
+type SearchHit struct {
+	NoteID    string  `json:"note_id"`
+	NoteTitle string  `json:"note_title"`
+	Source    string  `json:"source"`
+	SourceID  string  `json:"source_id"`
+	Rank      float64 `json:"rank"`
+	Snippet   string  `json:"snippet"`
+}
+
+// searchQuery ranks matches across the user's notes, quiz cards and OCR
+// blocks. Snippets are only built for the hits returned.
+const searchQuery = `
+	WITH query AS (SELECT websearch_to_tsquery('english', $2) AS q)
+	SELECT h.note_id, COALESCE(h.note_title, ''), h.source, h.source_id, h.rank,
+		ts_headline('english', h.document, query.q,
+			'StartSel=` + snippetStart + `, StopSel=` + snippetStop + `, MaxWords=35, MinWords=15, MaxFragments=2')
+	FROM (
+		SELECT n.id AS note_id, n.title AS note_title, 'note' AS source, n.id AS source_id,
+			ts_rank(n.search_vector, query.q) AS rank,
+			concat_ws(' ', n.summary, n.content) AS document
+		FROM notes n, query
+		WHERE n.user_id = $1 AND n.search_vector @@ query.q
+		UNION ALL
+		SELECT n.id, n.title, 'quiz_card', c.id,
+			ts_rank(c.search_vector, query.q),
+			concat_ws(' ', c.question, c.answer)
+		FROM quiz_cards c JOIN notes n ON n.id = c.note_id, query
+		WHERE n.user_id = $1 AND c.search_vector @@ query.q
+		UNION ALL
+		SELECT n.id, n.title, 'ocr_block', o.id,
+			ts_rank(o.search_vector, query.q),
+			COALESCE(o.text, '')
+		FROM ocr_blocks o JOIN notes n ON n.id = o.note_id, query
+		WHERE n.user_id = $1 AND o.search_vector @@ query.q
+		ORDER BY rank DESC, note_id, source_id
+		LIMIT $3
+	) h, query
+	ORDER BY h.rank DESC, h.note_id, h.source_id
+`
+
+// highlightSnippet escapes a ts_headline snippet for HTML and turns the
+// match markers into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, snippetStart, "<mark>")
+	return strings.ReplaceAll(escaped, snippetStop, "</mark>")
+}
+
+// searchNotes runs a web-style query (quoted phrases, OR, -exclusions)
+// over the user's notes, summaries, quiz cards and OCR text
+func searchNotes(c *fiber.Ctx) error {
+	errs := FieldErrors{}
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		errs["q"] = "Search query is required"
+	} else if len(q) > maxSearchQueryBytes {
+		errs["q"] = fmt.Sprintf("Search query must be at most %d bytes", maxSearchQueryBytes)
+	}
+	limit := defaultSearchLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			errs["limit"] = fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit)
+		}
+		limit = n
+	}
+	if len(errs) > 0 {
+		return validationError(c, errs)
+	}
+
+	rows, err := db.Query(searchQuery, currentUserID(c), q, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search notes",
+		})
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var hit SearchHit
+		if err := rows.Scan(&hit.NoteID, &hit.NoteTitle, &hit.Source, &hit.SourceID, &hit.Rank, &hit.Snippet); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan search result",
+			})
+		}
+		hit.Snippet = highlightSnippet(hit.Snippet)
+		hits = append(hits, hit)
+	}
+
+	return c.JSON(hits)
+}
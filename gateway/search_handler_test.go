@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var searchColumns = []string{"note_id", "note_title", "source", "source_id", "rank", "snippet"}
+
+func TestHighlightSnippet(t *testing.T) {
+	snippet := "the " + snippetStart + "mitochondria" + snippetStop + " <script>"
+	assert.Equal(t, "the <mark>mitochondria</mark> &lt;script&gt;", highlightSnippet(snippet))
+}
+
+func TestSearchNotes(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/search", withUser("user-1"), searchNotes)
+
+	// Every branch of the query is limited to the user's notes
+	mock.ExpectQuery("websearch_to_tsquery\\('english', \\$2\\)").
+		WithArgs("user-1", `"cell membrane" -plant`, defaultSearchLimit).
+		WillReturnRows(sqlmock.NewRows(searchColumns).
+			AddRow(testNoteID, "Cells", "quiz_card", "card-1", 0.6, "What surrounds the "+snippetStart+"cell"+snippetStop+"?").
+			AddRow(testNoteID, "Cells", "note", testNoteID, 0.2, "The "+snippetStart+"cell"+snippetStop+" membrane"))
+
+	req := httptest.NewRequest("GET", "/api/search?q="+url.QueryEscape(` "cell membrane" -plant `), nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var hits []SearchHit
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&hits))
+	if assert.Len(t, hits, 2) {
+		assert.Equal(t, "quiz_card", hits[0].Source)
+		assert.Equal(t, testNoteID, hits[0].NoteID)
+		assert.Equal(t, "What surrounds the <mark>cell</mark>?", hits[0].Snippet)
+	}
+}
+
+func TestSearchNotes_UserBoundary(t *testing.T) {
+	assert.Equal(t, 3, strings.Count(searchQuery, "n.user_id = $1"))
+}
+
+func TestSearchNotes_InvalidQuery(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/search", withUser("user-1"), searchNotes)
+
+	for _, query := range []string{"", "q=%20", "q=cell&limit=0", "q=cell&limit=500", "q=" + strings.Repeat("a", maxSearchQueryBytes+1)} {
+		req := httptest.NewRequest("GET", "/api/search?"+query, nil)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
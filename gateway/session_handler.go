@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// revokeFamilyQuery deletes a session and every rotation of its refresh
+// token, provided the session belongs to the user.
+const revokeFamilyQuery = `
+	DELETE FROM sessions
+	WHERE user_id = $2 AND family_id IN (SELECT family_id FROM sessions WHERE id = $1)
+`
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type Session struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	Current   bool      `json:"current"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func logout(c *fiber.Ctx) error {
+	// Revoke the session used for this request along with its token family
+	_, err := db.Exec(
+		revokeFamilyQuery,
+		currentSessionID(c),
+		currentUserID(c),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	clearSessionCookies(c)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func listSessions(c *fiber.Ctx) error {
+	// Get active sessions for the user
+	rows, err := db.Query(`
+		SELECT id, COALESCE(user_agent, ''), created_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > NOW() AND rotated_at IS NULL AND NOT mfa_pending
+		ORDER BY created_at DESC
+	`, currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch sessions",
+		})
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.Device, &session.CreatedAt, &session.ExpiresAt); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan session",
+			})
+		}
+		session.Current = session.ID == currentSessionID(c)
+		sessions = append(sessions, session)
+	}
+
+	return c.JSON(sessions)
+}
+
+func sessionNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Session not found",
+	})
+}
+
+func revokeSession(c *fiber.Ctx) error {
+	sessionID := c.Params("id")
+	if !validNoteID(sessionID) {
+		return sessionNotFound(c)
+	}
+
+	// Only sessions owned by the user can be revoked
+	result, err := db.Exec(
+		revokeFamilyQuery,
+		sessionID,
+		currentUserID(c),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return sessionNotFound(c)
+	}
+
+	if sessionID == currentSessionID(c) {
+		clearSessionCookies(c)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func revokeAllSessions(c *fiber.Ctx) error {
+	// Log out everywhere, including the current session
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = $1", currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	clearSessionCookies(c)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func refresh(c *fiber.Ctx) error {
+	// Get refresh token from body or cookie
+	var req RefreshRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if req.RefreshToken == "" {
+		req.RefreshToken = c.Cookies(refreshCookieName)
+	}
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Missing refresh token",
+		})
+	}
+
+	// Find the session the refresh token was issued to
+	var session struct {
+		ID        string
+		UserID    string
+		FamilyID  string
+		UserAgent sql.NullString
+		CreatedAt time.Time
+		ExpiresAt time.Time
+		RotatedAt sql.NullTime
+	}
+	err := db.QueryRow(`
+		SELECT id, user_id, family_id, user_agent, created_at, expires_at, rotated_at
+		FROM sessions
+		WHERE refresh_token_hash = $1
+	`, hashToken(req.RefreshToken)).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.FamilyID,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+		&session.RotatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid refresh token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify refresh token",
+		})
+	}
+
+	// A rotated token being presented again means it leaked
+	if session.RotatedAt.Valid {
+		return revokeReusedFamily(c, session.FamilyID, session.UserID)
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+
+	tokens, err := generateTokenPair(session.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	// Rotate: retire the presented token and continue the family
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE sessions SET rotated_at = NOW() WHERE id = $1 AND rotated_at IS NULL",
+		session.ID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate session",
+		})
+	}
+	if rotated, _ := result.RowsAffected(); rotated == 0 {
+		// Lost a race with a concurrent refresh of the same token
+		tx.Rollback()
+		return revokeReusedFamily(c, session.FamilyID, session.UserID)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO sessions (user_id, token_hash, refresh_token_hash, family_id, expires_at, user_agent, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		session.UserID,
+		hashToken(tokens.AccessToken),
+		hashToken(tokens.RefreshToken),
+		session.FamilyID,
+		session.ExpiresAt,
+		session.UserAgent,
+		session.CreatedAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate session",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	setSessionCookies(c, tokens, session.ExpiresAt)
+	return c.JSON(tokenResponse(session.UserID, tokens))
+}
+
+// revokeReusedFamily logs out every session descended from the same login
+// after a refresh token was replayed.
+func revokeReusedFamily(c *fiber.Ctx, familyID, userID string) error {
+	log.Printf("[WARN] Refresh token reuse detected for user %s, revoking family %s", userID, familyID)
+	if _, err := db.Exec("DELETE FROM sessions WHERE family_id = $1", familyID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	clearSessionCookies(c)
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": "Refresh token reuse detected",
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// withSession stands in for authMiddleware in session handler tests
+func withSession(userID, sessionID string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user_id", userID)
+		c.Locals("session_id", sessionID)
+		return c.Next()
+	}
+}
+
+func findCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func assertCookieCleared(t *testing.T, resp *http.Response) {
+	for _, name := range []string{cookieName, refreshCookieName} {
+		cookie := findCookie(resp, name)
+		if assert.NotNil(t, cookie, name) {
+			assert.Empty(t, cookie.Value)
+			assert.True(t, cookie.Expires.Before(time.Now()))
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/logout", withSession("user-1", "session-1"), logout)
+
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$2 AND family_id IN").
+		WithArgs("session-1", "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/auth/logout", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertCookieCleared(t, resp)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListSessions(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/auth/sessions", withSession("user-1", "session-2"), listSessions)
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT id, COALESCE\\(user_agent, ''\\), created_at, expires_at FROM sessions").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_agent", "created_at", "expires_at"}).
+			AddRow("session-2", "curl/8.0", now, now.Add(time.Hour)).
+			AddRow("session-1", "Mozilla/5.0", now.Add(-time.Hour), now.Add(time.Hour)))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/auth/sessions", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var sessions []Session
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "curl/8.0", sessions[0].Device)
+	assert.True(t, sessions[0].Current)
+	assert.False(t, sessions[1].Current)
+}
+
+const (
+	testSessionID      = "0f8e2a6c-9b4d-4d1e-a7c3-5b9f1e3d7a82"
+	testOtherSessionID = "b5d1f7a3-2e8c-4a6f-9d0b-7e3a5c1f9b48"
+)
+
+func TestRevokeSession(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/sessions/:id", withSession("user-1", "session-2"), revokeSession)
+
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$2 AND family_id IN").
+		WithArgs(testSessionID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/auth/sessions/"+testSessionID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSession_NotOwned(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/sessions/:id", withSession("user-1", "session-2"), revokeSession)
+
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$2 AND family_id IN").
+		WithArgs(testOtherSessionID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/auth/sessions/"+testOtherSessionID, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSession_MalformedID(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/sessions/:id", withSession("user-1", "session-2"), revokeSession)
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/auth/sessions/other-session", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/auth/sessions", withSession("user-1", "session-1"), revokeAllSessions)
+
+	mock.ExpectExec("DELETE FROM sessions WHERE user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/auth/sessions", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assertCookieCleared(t, resp)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSessionRoutes_RequireAuth(t *testing.T) {
+	app, _ := setupTestApp()
+	defer db.Close()
+	setupRoutes(app)
+
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/auth/logout"},
+		{"GET", "/auth/sessions"},
+		{"DELETE", "/auth/sessions"},
+		{"DELETE", "/auth/sessions/session-1"},
+	} {
+		resp, err := app.Test(httptest.NewRequest(route.method, route.path, strings.NewReader("")))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, route.path)
+	}
+}
+
+var refreshColumns = []string{"id", "user_id", "family_id", "user_agent", "created_at", "expires_at", "rotated_at"}
+
+func TestRefresh_RotatesToken(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/refresh", refresh)
+
+	createdAt := time.Now().Add(-time.Hour)
+	expiresAt := time.Now().Add(24 * time.Hour)
+	mock.ExpectQuery("SELECT id, user_id, family_id, user_agent, created_at, expires_at, rotated_at FROM sessions").
+		WithArgs(hashToken("old-refresh-token")).
+		WillReturnRows(sqlmock.NewRows(refreshColumns).
+			AddRow("session-1", "user-1", "family-1", "curl/8.0", createdAt, expiresAt, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET rotated_at = NOW\\(\\) WHERE id = \\$1 AND rotated_at IS NULL").
+		WithArgs("session-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	var storedToken string
+	mock.ExpectExec("INSERT INTO sessions").
+		WithArgs("user-1", captureArg{&storedToken}, sqlmock.AnyArg(), "family-1", expiresAt, sqlmock.AnyArg(), createdAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refresh_token":"old-refresh-token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "user-1", result["user_id"])
+	assert.NotEmpty(t, result["token"])
+	assert.NotEmpty(t, result["refresh_token"])
+	assert.NotEqual(t, "old-refresh-token", result["refresh_token"])
+	assert.Equal(t, hashToken(result["token"].(string)), storedToken)
+	assert.EqualValues(t, accessTokenExpiry.Seconds(), result["expires_in"])
+	assert.Equal(t, result["refresh_token"], findCookie(resp, refreshCookieName).Value)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_FromCookie(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/refresh", refresh)
+
+	mock.ExpectQuery("SELECT id, user_id, family_id, user_agent, created_at, expires_at, rotated_at FROM sessions").
+		WithArgs(hashToken("cookie-refresh-token")).
+		WillReturnError(sql.ErrNoRows)
+
+	req := httptest.NewRequest("POST", "/auth/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: refreshCookieName, Value: "cookie-refresh-token"})
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_ReuseRevokesFamily(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/refresh", refresh)
+
+	mock.ExpectQuery("SELECT id, user_id, family_id, user_agent, created_at, expires_at, rotated_at FROM sessions").
+		WithArgs(hashToken("stolen-refresh-token")).
+		WillReturnRows(sqlmock.NewRows(refreshColumns).
+			AddRow("session-1", "user-1", "family-1", "curl/8.0", time.Now(), time.Now().Add(time.Hour), time.Now()))
+	mock.ExpectExec("DELETE FROM sessions WHERE family_id = \\$1").
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	req := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refresh_token":"stolen-refresh-token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assertCookieCleared(t, resp)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_ConcurrentRotationRevokesFamily(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/refresh", refresh)
+
+	mock.ExpectQuery("SELECT id, user_id, family_id, user_agent, created_at, expires_at, rotated_at FROM sessions").
+		WithArgs(hashToken("raced-refresh-token")).
+		WillReturnRows(sqlmock.NewRows(refreshColumns).
+			AddRow("session-1", "user-1", "family-1", nil, time.Now(), time.Now().Add(time.Hour), nil))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET rotated_at").
+		WithArgs("session-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectExec("DELETE FROM sessions WHERE family_id = \\$1").
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	req := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(`{"refresh_token":"raced-refresh-token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_MissingToken(t *testing.T) {
+	app, _ := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/refresh", refresh)
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/auth/refresh", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+const (
+	maxTagLength      = 50
+	maxTagsPerRequest = 20
+)
+
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+// TagCount is a tag with the number of the user's notes carrying it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// normalizeTag trims, collapses whitespace and lower-cases a tag, the form
+// tags are stored in
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// validateTag checks a normalised tag. Commas separate tags in the listing
+// filter, so they cannot be part of one.
+func validateTag(tag string) string {
+	switch {
+	case tag == "":
+		return "Tag cannot be empty"
+	case len(tag) > maxTagLength:
+		return fmt.Sprintf("Tag must be at most %d characters", maxTagLength)
+	case strings.Contains(tag, ","):
+		return "Tag cannot contain commas"
+	}
+	return ""
+}
+
+// tagParam reads the tag from the path, where it is percent-encoded
+func tagParam(c *fiber.Ctx) string {
+	tag, err := url.PathUnescape(c.Params("tag"))
+	if err != nil {
+		return ""
+	}
+	return normalizeTag(tag)
+}
+
+func noteTags(noteID string) ([]string, error) {
+	rows, err := db.Query("SELECT tag FROM tags WHERE note_id = $1 ORDER BY tag", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// addNoteTags tags a note; tags it already has are left alone
+func addNoteTags(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	var req TagsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(req.Tags) == 0 || len(req.Tags) > maxTagsPerRequest {
+		return validationError(c, FieldErrors{"tags": fmt.Sprintf("Between 1 and %d tags are required", maxTagsPerRequest)})
+	}
+	tags := []string{}
+	for _, tag := range req.Tags {
+		tag = normalizeTag(tag)
+		if msg := validateTag(tag); msg != "" {
+			return validationError(c, FieldErrors{"tags": msg})
+		}
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	var owned bool
+	err := db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM notes WHERE id = $1 AND user_id = $2)",
+		noteID,
+		currentUserID(c),
+	).Scan(&owned)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get note",
+		})
+	}
+	if !owned {
+		return noteNotFound(c)
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO tags (note_id, tag) SELECT $1, unnest($2::text[]) ON CONFLICT (note_id, tag) DO NOTHING",
+		noteID,
+		pq.Array(tags),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add tags",
+		})
+	}
+
+	all, err := noteTags(noteID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch tags",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"tags": all,
+	})
+}
+
+func removeNoteTag(c *fiber.Ctx) error {
+	noteID := c.Params("id")
+	if !validNoteID(noteID) {
+		return noteNotFound(c)
+	}
+
+	result, err := db.Exec(
+		`DELETE FROM tags t USING notes n
+		WHERE t.note_id = n.id AND n.id = $1 AND n.user_id = $2 AND t.tag = $3`,
+		noteID,
+		currentUserID(c),
+		tagParam(c),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove tag",
+		})
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Tag not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// listTags returns the user's tags, most used first
+func listTags(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT t.tag, COUNT(*)
+		FROM tags t
+		JOIN notes n ON n.id = t.note_id
+		WHERE n.user_id = $1
+		GROUP BY t.tag
+		ORDER BY COUNT(*) DESC, t.tag ASC
+	`, currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch tags",
+		})
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan tag",
+			})
+		}
+		tags = append(tags, tag)
+	}
+
+	return c.JSON(tags)
+}
+
+// renameTag renames a tag on all of the user's notes. Renaming to a tag
+// the user already has merges the two.
+func renameTag(c *fiber.Ctx) error {
+	userID := currentUserID(c)
+	from := tagParam(c)
+
+	var req RenameTagRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	to := normalizeTag(req.Name)
+	if msg := validateTag(to); msg != "" {
+		return validationError(c, FieldErrors{"name": msg})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	// Notes that already carry the new name only lose the old one
+	merged, err := tx.Exec(
+		`DELETE FROM tags t USING notes n
+		WHERE t.note_id = n.id AND n.user_id = $1 AND t.tag = $2
+			AND EXISTS (SELECT 1 FROM tags o WHERE o.note_id = t.note_id AND o.tag = $3 AND o.id <> t.id)`,
+		userID,
+		from,
+		to,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rename tag",
+		})
+	}
+	renamed, err := tx.Exec(
+		`UPDATE tags t SET tag = $3 FROM notes n
+		WHERE t.note_id = n.id AND n.user_id = $1 AND t.tag = $2`,
+		userID,
+		from,
+		to,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rename tag",
+		})
+	}
+	mergedCount, _ := merged.RowsAffected()
+	renamedCount, _ := renamed.RowsAffected()
+	if mergedCount+renamedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Tag not found",
+		})
+	}
+
+	tag := TagCount{Tag: to}
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM tags t JOIN notes n ON n.id = t.note_id WHERE n.user_id = $1 AND t.tag = $2",
+		userID,
+		to,
+	).Scan(&tag.Count)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to count tag",
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+	return c.JSON(tag)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	assert.Equal(t, "machine learning", normalizeTag("  Machine \t Learning "))
+	assert.Equal(t, "", validateTag("biology"))
+	assert.NotEmpty(t, validateTag(""))
+	assert.NotEmpty(t, validateTag("cells,atoms"))
+	assert.NotEmpty(t, validateTag(strings.Repeat("a", maxTagLength+1)))
+}
+
+func TestAddNoteTags(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes/:id/tags", withUser("user-1"), addNoteTags)
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM notes WHERE id = \\$1 AND user_id = \\$2\\)").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// Normalised and de-duplicated before they are stored
+	mock.ExpectExec("INSERT INTO tags \\(note_id, tag\\) SELECT \\$1, unnest\\(\\$2::text\\[\\]\\) ON CONFLICT").
+		WithArgs(testNoteID, pq.Array([]string{"cell biology", "exam"})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT tag FROM tags WHERE note_id = \\$1").
+		WithArgs(testNoteID).
+		WillReturnRows(sqlmock.NewRows([]string{"tag"}).AddRow("biology").AddRow("cell biology").AddRow("exam"))
+
+	req := httptest.NewRequest("POST", "/api/notes/"+testNoteID+"/tags", strings.NewReader(`{"tags":["Cell  Biology","exam","EXAM"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var result struct {
+		Tags []string `json:"tags"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, []string{"biology", "cell biology", "exam"}, result.Tags)
+}
+
+func TestAddNoteTags_Rejected(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes/:id/tags", withUser("user-1"), addNoteTags)
+
+	for _, body := range []string{`{"tags":[]}`, `{"tags":["  "]}`, `{"tags":["a,b"]}`} {
+		req := httptest.NewRequest("POST", "/api/notes/"+testNoteID+"/tags", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	// Another user's note
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(testNoteID, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	req := httptest.NewRequest("POST", "/api/notes/"+testNoteID+"/tags", strings.NewReader(`{"tags":["exam"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRemoveNoteTag(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Delete("/api/notes/:id/tags/:tag", withUser("user-1"), removeNoteTag)
+
+	mock.ExpectExec("DELETE FROM tags t USING notes n").
+		WithArgs(testNoteID, "user-1", "machine learning").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM tags t USING notes n").
+		WithArgs(testNoteID, "user-1", "exam").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest("DELETE", "/api/notes/"+testNoteID+"/tags/Machine%20Learning", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	req = httptest.NewRequest("DELETE", "/api/notes/"+testNoteID+"/tags/exam", nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListTags(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Get("/api/tags", withUser("user-1"), listTags)
+
+	mock.ExpectQuery("SELECT t.tag, COUNT\\(\\*\\) FROM tags t JOIN notes n ON n.id = t.note_id WHERE n.user_id = \\$1").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tag", "count"}).AddRow("biology", 4).AddRow("exam", 1))
+
+	req := httptest.NewRequest("GET", "/api/tags", nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var tags []TagCount
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tags))
+	assert.Equal(t, []TagCount{{Tag: "biology", Count: 4}, {Tag: "exam", Count: 1}}, tags)
+}
+
+func TestRenameTag_Merges(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/tags/:tag", withUser("user-1"), renameTag)
+
+	// One note had both tags, two only the old one
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM tags t USING notes n .* AND EXISTS").
+		WithArgs("user-1", "bio", "biology").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE tags t SET tag = \\$3 FROM notes n").
+		WithArgs("user-1", "bio", "biology").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM tags t").
+		WithArgs("user-1", "biology").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("PATCH", "/api/tags/bio", strings.NewReader(`{"name":"Biology"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var tag TagCount
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tag))
+	assert.Equal(t, TagCount{Tag: "biology", Count: 5}, tag)
+}
+
+func TestRenameTag_NotFound(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Patch("/api/tags/:tag", withUser("user-1"), renameTag)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM tags t USING notes n").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE tags t SET tag = \\$3 FROM notes n").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("PATCH", "/api/tags/bio", strings.NewReader(`{"name":"biology"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
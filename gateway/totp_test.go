@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTP_RFC6238Vectors(t *testing.T) {
+	// SHA-1 test vectors from RFC 6238 appendix B
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+	for _, tt := range tests {
+		step := totpStep(time.Unix(tt.unix, 0))
+		assert.Equal(t, tt.code, hotp(key, step, 8), "time %d", tt.unix)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	key := []byte("12345678901234567890")
+	current := totpStep(now)
+
+	step, ok := validateTOTP(secret, hotp(key, current, 6), now)
+	assert.True(t, ok)
+	assert.Equal(t, current, step)
+
+	// One step of drift either way is tolerated
+	step, ok = validateTOTP(secret, hotp(key, current-1, 6), now)
+	assert.True(t, ok)
+	assert.Equal(t, current-1, step)
+	_, ok = validateTOTP(secret, hotp(key, current+1, 6), now)
+	assert.True(t, ok)
+
+	_, ok = validateTOTP(secret, hotp(key, current-2, 6), now)
+	assert.False(t, ok)
+	_, ok = validateTOTP(secret, "12345", now)
+	assert.False(t, ok)
+	_, ok = validateTOTP("not base32!", "123456", now)
+	assert.False(t, ok)
+
+	// Lower-case secrets and spaced codes, as typed by hand
+	code := hotp(key, current, 6)
+	_, ok = validateTOTP(strings.ToLower(secret), code[:3]+" "+code[3:], now)
+	assert.True(t, ok)
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri, err := url.Parse(otpauthURI("JBSWY3DPEHPK3PXP", "ada@example.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/NeuroNote:ada@example.com", uri.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	assert.Equal(t, "NeuroNote", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+		assert.False(t, seen[code], "duplicate code %s", code)
+		seen[code] = true
+	}
+	assert.Equal(t, normalizeRecoveryCode(codes[0]), normalizeRecoveryCode(" "+strings.ToUpper(codes[0])))
+	assert.Equal(t, normalizeRecoveryCode(codes[0]), normalizeRecoveryCode(strings.ReplaceAll(codes[0], "-", "")))
+}
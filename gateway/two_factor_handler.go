@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// mfaTokenType marks the token of a login that still needs its second
+	// factor. authMiddleware refuses it.
+	mfaTokenType       = "mfa"
+	mfaChallengeExpiry = 5 * time.Minute
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorVerifyRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// startPartialSession records a session that only the second factor can
+// complete and returns its mfa token. The session's refresh token is never
+// handed out, so it cannot be refreshed either.
+func startPartialSession(c *fiber.Ctx, userID string) (string, error) {
+	token, err := signToken(userID, mfaTokenType, mfaChallengeExpiry)
+	if err != nil {
+		return "", err
+	}
+	placeholder, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(mfaChallengeExpiry)
+	_, err = db.Exec(
+		`INSERT INTO sessions (user_id, token_hash, refresh_token_hash, family_id, expires_at, user_agent, mfa_pending)
+		VALUES ($1, $2, $3, $4, $5, $6, TRUE)`,
+		userID,
+		hashToken(token),
+		hashToken(placeholder),
+		uuid.New().String(),
+		expiresAt,
+		deviceHint(c),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     cookieName,
+		Value:    token,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Strict",
+		MaxAge:   int(mfaChallengeExpiry.Seconds()),
+	})
+	return token, nil
+}
+
+func setupTwoFactor(c *fiber.Ctx) error {
+	userID := currentUserID(c)
+
+	var email string
+	var enabledAt sql.NullTime
+	err := db.QueryRow(
+		"SELECT email, totp_enabled_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&email, &enabledAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	if enabledAt.Valid {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	// Starting over replaces any secret that was never confirmed
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+	_, err = db.Exec(
+		"UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_enabled_at IS NULL",
+		secret,
+		userID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save secret",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(secret, email),
+	})
+}
+
+func confirmTwoFactor(c *fiber.Ctx) error {
+	userID := currentUserID(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	err := db.QueryRow(
+		"SELECT totp_secret, totp_enabled_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&secret, &enabledAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	if enabledAt.Valid {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+	if !secret.Valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Two-factor setup has not been started",
+		})
+	}
+
+	// Proves the authenticator app holds the secret
+	step, ok := validateTOTP(secret.String, req.Code, time.Now())
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start transaction",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $2 WHERE id = $1 AND totp_enabled_at IS NULL",
+		userID,
+		step,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store recovery codes",
+		})
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID,
+			hashToken(normalizeRecoveryCode(code)),
+		)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to store recovery codes",
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	// The codes are shown once; only their digests are kept
+	return c.JSON(fiber.Map{
+		"recovery_codes": codes,
+	})
+}
+
+// verifyTwoFactor completes a login started with an mfa token, accepting a
+// TOTP code or an unused recovery code.
+func verifyTwoFactor(c *fiber.Ctx) error {
+	token, err := extractToken(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	claims := &Claims{}
+	parsedToken, err := jwt.ParseWithClaims(token, claims, signingKeys.keyfunc)
+	if err != nil || !parsedToken.Valid || claims.TokenType != mfaTokenType {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid token",
+		})
+	}
+
+	var req TwoFactorVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Find the pending session
+	var sessionID string
+	var expiresAt time.Time
+	err = db.QueryRow(
+		"SELECT id, expires_at FROM sessions WHERE token_hash = $1 AND user_id = $2 AND mfa_pending",
+		hashToken(token),
+		claims.UserID,
+	).Scan(&sessionID, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(expiresAt)) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify session",
+		})
+	}
+
+	var user struct {
+		Email  string
+		Secret string
+	}
+	err = db.QueryRow(
+		"SELECT email, totp_secret FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL",
+		claims.UserID,
+	).Scan(&user.Email, &user.Secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	// Codes are short, so they share the password's attempt limits
+	ip := c.IP()
+	attempt, wait, err := loginLimiter.Reserve(c.Context(), user.Email, ip)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check login attempts",
+		})
+	}
+	if wait > 0 {
+		auditLoginFailure(user.Email, ip, deviceHint(c), "rate_limited")
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many login attempts",
+		})
+	}
+
+	var accepted bool
+	switch {
+	case req.Code != "":
+		accepted, err = useTOTPCode(claims.UserID, user.Secret, req.Code)
+	case req.RecoveryCode != "":
+		accepted, err = useRecoveryCode(claims.UserID, req.RecoveryCode)
+	default:
+		releaseLoginAttempt(c, attempt)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A code or recovery code is required",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify code",
+		})
+	}
+	if !accepted {
+		auditLoginFailure(user.Email, ip, deviceHint(c), "invalid_second_factor")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	if err := attempt.Succeed(c.Context()); err != nil {
+		log.Printf("[ERROR] Failed to reset login attempts: %v", err)
+	}
+
+	// Upgrade the pending session in place
+	tokens, err := generateTokenPair(claims.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+	sessionExpiresAt := time.Now().Add(refreshTokenExpiry)
+	result, err := db.Exec(
+		`UPDATE sessions SET token_hash = $2, refresh_token_hash = $3, expires_at = $4, mfa_pending = FALSE
+		WHERE id = $1 AND mfa_pending`,
+		sessionID,
+		hashToken(tokens.AccessToken),
+		hashToken(tokens.RefreshToken),
+		sessionExpiresAt,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create session",
+		})
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session expired",
+		})
+	}
+
+	setSessionCookies(c, tokens, sessionExpiresAt)
+	return c.JSON(tokenResponse(claims.UserID, tokens))
+}
+
+// useTOTPCode accepts a valid code once: a step at or before the last one
+// used is refused, so an observed code cannot be replayed.
+func useTOTPCode(userID, secret, code string) (bool, error) {
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	result, err := db.Exec(
+		"UPDATE users SET totp_last_step = $2 WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)",
+		userID,
+		step,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// useRecoveryCode spends one of the user's unused recovery codes
+func useRecoveryCode(userID, code string) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID,
+		hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// currentTOTP returns the code an authenticator app would show right now
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	assert.NoError(t, err)
+	return hotp(key, totpStep(time.Now()), totpDigits)
+}
+
+func setupTwoFactorTestApp(t *testing.T) (*fiber.App, sqlmock.Sqlmock) {
+	t.Helper()
+	app, mock := setupTestApp()
+	t.Cleanup(func() { db.Close() })
+	app.Post("/auth/login", login)
+	app.Post("/auth/2fa/verify", verifyTwoFactor)
+	app.Get("/api/whoami", authMiddleware(), func(c *fiber.Ctx) error {
+		return c.SendString(currentUserID(c))
+	})
+	return app, mock
+}
+
+// loginWithTwoFactor runs the password step for a user with 2FA enabled
+// and returns the mfa token
+func loginWithTwoFactor(t *testing.T, app *fiber.App, mock sqlmock.Sqlmock) string {
+	t.Helper()
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	mock.ExpectQuery("SELECT id, hashed_password, totp_enabled_at IS NOT NULL, disabled_at IS NOT NULL FROM users").
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hashed_password", "totp_enabled", "disabled"}).AddRow("user-1", string(hashed), true, false))
+	mock.ExpectExec("INSERT INTO sessions \\(user_id, token_hash, refresh_token_hash, family_id, expires_at, user_agent, mfa_pending\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/auth/login", strings.NewReader(`{"email":"ada@example.com","password":"correct horse"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, true, result["mfa_required"])
+	assert.Nil(t, result["token"])
+	assert.Nil(t, result["refresh_token"])
+	token, _ := result["mfa_token"].(string)
+	assert.NotEmpty(t, token)
+	return token
+}
+
+func expectPendingSession(mock sqlmock.Sqlmock, mfaToken string) {
+	mock.ExpectQuery("SELECT id, expires_at FROM sessions WHERE token_hash = \\$1 AND user_id = \\$2 AND mfa_pending").
+		WithArgs(hashToken(mfaToken), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at"}).AddRow("session-1", time.Now().Add(time.Minute)))
+	mock.ExpectQuery("SELECT email, totp_secret FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email", "totp_secret"}).AddRow("ada@example.com", testTOTPSecret))
+}
+
+func verifyRequest(mfaToken, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/auth/2fa/verify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+mfaToken)
+	return req
+}
+
+func TestLogin_TwoFactorTokenRejectedByMiddleware(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+	mfaToken := loginWithTwoFactor(t, app, mock)
+
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+mfaToken)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	var result map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, "Second factor required", result["error"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyTwoFactor_TOTP(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+	mfaToken := loginWithTwoFactor(t, app, mock)
+
+	expectPendingSession(mock, mfaToken)
+	mock.ExpectExec("UPDATE users SET totp_last_step = \\$2").
+		WithArgs("user-1", totpStep(time.Now())).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	var storedToken string
+	mock.ExpectExec("UPDATE sessions SET token_hash = \\$2, refresh_token_hash = \\$3, expires_at = \\$4, mfa_pending = FALSE").
+		WithArgs("session-1", captureArg{&storedToken}, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(verifyRequest(mfaToken, `{"code":"`+currentTOTP(t, testTOTPSecret)+`"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	token, _ := result["token"].(string)
+	assert.NotEmpty(t, token)
+	assert.NotEmpty(t, result["refresh_token"])
+	assert.Equal(t, hashToken(token), storedToken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// The upgraded token passes authMiddleware
+	mock.ExpectQuery("SELECT s.id, s.expires_at, u.role FROM sessions s JOIN users u").
+		WithArgs(hashToken(token), "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "role"}).AddRow("session-1", time.Now().Add(time.Hour), "user"))
+	req := httptest.NewRequest("GET", "/api/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestVerifyTwoFactor_ReplayedCodeRejected(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+	mfaToken := loginWithTwoFactor(t, app, mock)
+
+	// The step was already used, so the guarded update matches nothing
+	expectPendingSession(mock, mfaToken)
+	mock.ExpectExec("UPDATE users SET totp_last_step = \\$2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO login_audit").
+		WithArgs("ada@example.com", sqlmock.AnyArg(), sqlmock.AnyArg(), "invalid_second_factor").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(verifyRequest(mfaToken, `{"code":"`+currentTOTP(t, testTOTPSecret)+`"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyTwoFactor_RecoveryCode(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+	mfaToken := loginWithTwoFactor(t, app, mock)
+
+	expectPendingSession(mock, mfaToken)
+	mock.ExpectExec("UPDATE recovery_codes SET used_at = NOW\\(\\)").
+		WithArgs("user-1", hashToken("abcde23456")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET token_hash = \\$2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(verifyRequest(mfaToken, `{"recovery_code":"ABCDE-23456"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyTwoFactor_WrongCodesAreThrottled(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+	mfaToken := loginWithTwoFactor(t, app, mock)
+
+	// Free attempts run out, then the first delay applies
+	failures := emailLimitPolicy.FreeAttempts + 1
+	for i := 0; i <= failures; i++ {
+		expectPendingSession(mock, mfaToken)
+		if i < failures {
+			mock.ExpectExec("UPDATE recovery_codes SET used_at = NOW\\(\\)").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec("INSERT INTO login_audit").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	for i := 0; i < failures; i++ {
+		resp, err := app.Test(verifyRequest(mfaToken, `{"recovery_code":"wrong-guess"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// The next guess has to wait, whatever the code
+	resp, err := app.Test(verifyRequest(mfaToken, `{"code":"`+currentTOTP(t, testTOTPSecret)+`"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyTwoFactor_RequiresMFAToken(t *testing.T) {
+	app, mock := setupTwoFactorTestApp(t)
+
+	// A full access token cannot be used to skip the pending step
+	token, err := generateToken("user-1")
+	assert.NoError(t, err)
+	resp, err := app.Test(verifyRequest(token, `{"code":"123456"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetupAndConfirmTwoFactor(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/2fa/setup", withUser("user-1"), setupTwoFactor)
+	app.Post("/auth/2fa/confirm", withUser("user-1"), confirmTwoFactor)
+
+	mock.ExpectQuery("SELECT email, totp_enabled_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email", "totp_enabled_at"}).AddRow("ada@example.com", nil))
+	var storedSecret string
+	mock.ExpectExec("UPDATE users SET totp_secret = \\$1 WHERE id = \\$2 AND totp_enabled_at IS NULL").
+		WithArgs(captureArg{&storedSecret}, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/auth/2fa/setup", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var setup map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&setup))
+	assert.Equal(t, storedSecret, setup["secret"])
+	assert.True(t, strings.HasPrefix(setup["otpauth_uri"], "otpauth://totp/NeuroNote:ada@example.com?"))
+
+	// Confirm with a code from the new secret
+	mock.ExpectQuery("SELECT totp_secret, totp_enabled_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at"}).AddRow(storedSecret, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET totp_enabled_at = NOW\\(\\)").
+		WithArgs("user-1", totpStep(time.Now())).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	storedCodes := make([]string, recoveryCodeCount)
+	for i := range storedCodes {
+		mock.ExpectExec("INSERT INTO recovery_codes").
+			WithArgs("user-1", captureArg{&storedCodes[i]}).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/auth/2fa/confirm", strings.NewReader(`{"code":"`+currentTOTP(t, storedSecret)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var confirm struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&confirm))
+	assert.Len(t, confirm.RecoveryCodes, recoveryCodeCount)
+	for i, code := range confirm.RecoveryCodes {
+		assert.Equal(t, hashToken(normalizeRecoveryCode(code)), storedCodes[i])
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConfirmTwoFactor_WrongCode(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/2fa/confirm", withUser("user-1"), confirmTwoFactor)
+
+	mock.ExpectQuery("SELECT totp_secret, totp_enabled_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at"}).AddRow(testTOTPSecret, nil))
+
+	req := httptest.NewRequest("POST", "/auth/2fa/confirm", strings.NewReader(`{"code":"000000x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetupTwoFactor_AlreadyEnabled(t *testing.T) {
+	app, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/auth/2fa/setup", withUser("user-1"), setupTwoFactor)
+
+	mock.ExpectQuery("SELECT email, totp_enabled_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email", "totp_enabled_at"}).AddRow("ada@example.com", time.Now()))
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/auth/2fa/setup", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
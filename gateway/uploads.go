@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Bodies up to requestBodyLimit are read into memory before a handler
+	// runs; larger ones are streamed and only uploads accept them
+	requestBodyLimit      = fiber.DefaultBodyLimit
+	defaultMaxUploadBytes = 1 << 30
+	// Form fields sent along with an uploaded file are short
+	maxUploadFieldBytes = 1024
+)
+
+// uploadDir is where the original files of uploaded notes are kept, from
+// UPLOAD_DIR. Each user has a directory of files named by their note_files
+// id, so client filenames never reach the filesystem. An upload is staged
+// under its job id, which becomes the note_files id.
+var uploadDir = "uploads"
+
+// maxUploadBytes caps an upload request, from MAX_UPLOAD_BYTES
+var maxUploadBytes int64 = defaultMaxUploadBytes
+
+// errUploadTooLarge is returned once a request body passes maxUploadBytes
+var errUploadTooLarge = errors.New("upload too large")
+
+// NoteFile is the original file a note was created from
+type NoteFile struct {
+	ID          string    `json:"id"`
+	NoteID      string    `json:"note_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	SizeBytes   int64     `json:"size_bytes"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func uploadPath(userID, fileID string) string {
+	return filepath.Join(uploadDir, userID, fileID)
+}
+
+// removeUpload deletes one stored file; a file already gone is not an error
+func removeUpload(userID, fileID string) error {
+	err := os.Remove(uploadPath(userID, fileID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeUploads deletes every stored file of the user
+func removeUploads(userID string) error {
+	if userID == "" || filepath.Base(userID) != userID {
+		return fmt.Errorf("invalid user id %q", userID)
+	}
+	return os.RemoveAll(filepath.Join(uploadDir, userID))
+}
+
+// loadMaxUploadBytes reads MAX_UPLOAD_BYTES, the largest upload request
+// accepted
+func loadMaxUploadBytes() (int64, error) {
+	value := os.Getenv("MAX_UPLOAD_BYTES")
+	if value == "" {
+		return defaultMaxUploadBytes, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid MAX_UPLOAD_BYTES %q", value)
+	}
+	return n, nil
+}
+
+// streamsBody tells the routes that may send bodies past requestBodyLimit,
+// which they write to disk as they arrive
+func streamsBody(c *fiber.Ctx) bool {
+	switch c.Method() {
+	case fiber.MethodPost:
+		return c.Path() == "/api/notes" || c.Path() == "/api/notes/upload"
+	case fiber.MethodPatch:
+		return strings.HasPrefix(c.Path(), "/api/uploads/")
+	}
+	return false
+}
+
+// limitBody holds every route but the upload routes to requestBodyLimit.
+// The server streams bodies larger than that, so they are read here as
+// they would otherwise have been.
+func limitBody(c *fiber.Ctx) error {
+	if !c.Request().IsBodyStream() || streamsBody(c) {
+		return c.Next()
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Context().RequestBodyStream(), requestBodyLimit+1))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read request body",
+		})
+	}
+	if len(body) > requestBodyLimit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "Request body too large",
+		})
+	}
+	c.Request().SetBody(body)
+	return c.Next()
+}
+
+// uploadTooLarge answers a request over maxUploadBytes
+func uploadTooLarge(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+		"error":     "Upload too large",
+		"max_bytes": maxUploadBytes,
+	})
+}
+
+// limitedReader fails with errUploadTooLarge instead of stopping quietly
+// at its limit
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only fail if there is more to read
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errUploadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// requestBody is the request body, failing with errUploadTooLarge past
+// limit. A body the server streamed is read from the connection as the
+// handler consumes it.
+func requestBody(c *fiber.Ctx, limit int64) io.Reader {
+	if c.Request().IsBodyStream() {
+		return &limitedReader{r: c.Context().RequestBodyStream(), remaining: limit}
+	}
+	return &limitedReader{r: bytes.NewReader(c.Request().Body()), remaining: limit}
+}
+
+// stagedUpload is an uploaded file written to disk and the form fields
+// sent with it
+type stagedUpload struct {
+	Filename    string
+	ContentType string
+	SizeBytes   int64
+	Fields      map[string]string
+}
+
+// errNoUploadFile is returned by stageUpload when the request is not a
+// readable form with a file
+var errNoUploadFile = errors.New("no file uploaded")
+
+// uploadError tells a request that could not be read from a failure to
+// store it, which comes back as a *os.PathError
+func uploadError(err error) error {
+	var pathErr *os.PathError
+	if errors.Is(err, errUploadTooLarge) || errors.As(err, &pathErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errNoUploadFile, err)
+}
+
+// stageUpload writes the "file" part of a multipart upload to path as it
+// arrives, so the upload is never held in memory. Other short fields are
+// collected wherever they appear in the form. The file is removed again if
+// the request cannot be read to the end.
+func stageUpload(c *fiber.Ctx, path string) (upload *stagedUpload, err error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, errNoUploadFile
+	}
+
+	upload = &stagedUpload{Fields: map[string]string{}}
+	staged := false
+	defer func() {
+		if err != nil && staged {
+			os.Remove(path)
+		}
+	}()
+
+	body := requestBody(c, maxUploadBytes)
+	form := multipart.NewReader(body, boundary)
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			// Read the body to its end, or the rest of a chunked body would
+			// be taken for the connection's next request
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				return nil, uploadError(err)
+			}
+			break
+		}
+		if err != nil {
+			return nil, uploadError(err)
+		}
+
+		switch {
+		case part.FormName() == "file" && part.FileName() != "" && !staged:
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return nil, err
+			}
+			staged = true
+			if upload.SizeBytes, err = writeUpload(path, part); err != nil {
+				return nil, uploadError(err)
+			}
+			upload.Filename = filepath.Base(part.FileName())
+			upload.ContentType = part.Header.Get("Content-Type")
+		case part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				return nil, uploadError(err)
+			}
+			upload.Fields[part.FormName()] = string(value)
+		}
+		// Whatever is left of the part is skipped by NextPart
+	}
+
+	if !staged {
+		return nil, errNoUploadFile
+	}
+	return upload, nil
+}
+
+func writeUpload(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
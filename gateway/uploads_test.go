@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStreamingApp is configured like the gateway's app, streaming bodies
+// past requestBodyLimit
+func newStreamingApp() *fiber.App {
+	app := fiber.New(fiber.Config{
+		BodyLimit:                    requestBodyLimit,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		DisableStartupMessage:        true,
+	})
+	app.Use(limitBody)
+	return app
+}
+
+// uploadForm builds a multipart form with a file of the given content and
+// the fields after it
+func uploadForm(t testing.TB, filename string, content []byte, fields ...string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	assert.NoError(t, err)
+	_, err = part.Write(content)
+	assert.NoError(t, err)
+	for i := 0; i+1 < len(fields); i += 2 {
+		assert.NoError(t, writer.WriteField(fields[i], fields[i+1]))
+	}
+	assert.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+// serveApp runs app on a local port for requests app.Test cannot send,
+// such as chunked bodies
+func serveApp(t testing.TB, app *fiber.App) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() {
+		// Idle keep-alive connections would hold up the shutdown
+		http.DefaultClient.CloseIdleConnections()
+		app.Shutdown()
+	})
+	return "http://" + listener.Addr().String()
+}
+
+func limitUploads(t testing.TB, n int64) {
+	previous := maxUploadBytes
+	maxUploadBytes = n
+	t.Cleanup(func() { maxUploadBytes = previous })
+}
+
+func TestLoadMaxUploadBytes(t *testing.T) {
+	t.Setenv("MAX_UPLOAD_BYTES", "")
+	n, err := loadMaxUploadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(defaultMaxUploadBytes), n)
+
+	t.Setenv("MAX_UPLOAD_BYTES", "1048576")
+	n, err = loadMaxUploadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1048576), n)
+
+	for _, value := range []string{"0", "-5", "1GB"} {
+		t.Setenv("MAX_UPLOAD_BYTES", value)
+		_, err = loadMaxUploadBytes()
+		assert.Error(t, err, value)
+	}
+}
+
+func TestUploadNote_TooLarge(t *testing.T) {
+	app := newStreamingApp()
+	_, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes", withUser("user-1"), uploadNote)
+	uploadDir = t.TempDir()
+	limitUploads(t, 1024)
+
+	// A declared length over the limit is refused before reading
+	body, contentType := uploadForm(t, "lecture.mp3", bytes.Repeat([]byte("a"), 2048))
+	req := httptest.NewRequest("POST", "/api/notes", body)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// A chunked body is cut off once it passes the limit
+	body, contentType = uploadForm(t, "lecture.mp3", bytes.Repeat([]byte("a"), 2048))
+	resp, err = http.Post(serveApp(t, app)+"/api/notes", contentType, io.MultiReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp.Body.Close()
+
+	// Nothing is left staged
+	stored, _ := os.ReadDir(filepath.Join(uploadDir, "user-1"))
+	assert.Empty(t, stored)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUploadNote_Streamed(t *testing.T) {
+	app := newStreamingApp()
+	_, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes", withUser("user-1"), uploadNote)
+	uploadDir = t.TempDir()
+
+	// The notebook may follow the file in the form
+	content := bytes.Repeat([]byte("lecture "), requestBodyLimit/8+1)
+	expectNotebookOwned(mock, "user-1", true)
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO jobs").
+		WithArgs(sqlmock.AnyArg(), "user-1", testNotebookID, "lecture.txt", "text/plain", len(content)).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(testJobID, "queued", "", "", "", "lecture.txt", "text/plain", len(content), now, nil, nil))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{`form-data; name="file"; filename="lecture.txt"`}
+	header["Content-Type"] = []string{"text/plain"}
+	part, err := writer.CreatePart(header)
+	assert.NoError(t, err)
+	part.Write(content)
+	writer.WriteField("notebook_id", testNotebookID)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/notes", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := app.Test(req, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	data, err := os.ReadFile(uploadPath("user-1", mustReadDir(t, filepath.Join(uploadDir, "user-1"))))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestUploadNote_NoFile(t *testing.T) {
+	app := newStreamingApp()
+	_, mock := setupTestApp()
+	defer db.Close()
+	app.Post("/api/notes", withUser("user-1"), uploadNote)
+	uploadDir = t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("notebook_id", testNotebookID)
+	writer.Close()
+
+	form := httptest.NewRequest("POST", "/api/notes", body)
+	form.Header.Set("Content-Type", writer.FormDataContentType())
+	notForm := httptest.NewRequest("POST", "/api/notes", strings.NewReader(`{"file":"x"}`))
+	notForm.Header.Set("Content-Type", "application/json")
+
+	for _, req := range []*http.Request{form, notForm} {
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLimitBody(t *testing.T) {
+	app := newStreamingApp()
+	app.Post("/api/notebooks", func(c *fiber.Ctx) error {
+		return c.SendString(fmt.Sprint(len(c.Body())))
+	})
+
+	url := serveApp(t, app) + "/api/notebooks"
+
+	// Small chunked bodies still reach the handler
+	resp, err := http.Post(url, "application/json", io.MultiReader(strings.NewReader(`{"name":"Biology"}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "18", string(got))
+
+	// Only the upload routes take large bodies
+	for _, body := range []io.Reader{
+		bytes.NewReader(make([]byte, requestBodyLimit+1)),
+		io.MultiReader(bytes.NewReader(make([]byte, requestBodyLimit+1))),
+	} {
+		resp, err = http.Post(url, "application/json", body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func mustReadDir(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if len(entries) != 1 {
+		t.Fatalf("expected one staged file in %s, found %d", dir, len(entries))
+	}
+	return entries[0].Name()
+}
+
+// generatedUpload produces a multipart upload of size bytes without
+// holding it in memory
+func generatedUpload(size int64) (io.Reader, string) {
+	boundary := "neuronote-benchmark-boundary"
+	head := "--" + boundary + "\r\n" +
+		`Content-Disposition: form-data; name="file"; filename="lecture.mp3"` + "\r\n" +
+		"Content-Type: audio/mpeg\r\n\r\n"
+	tail := "\r\n--" + boundary + "--\r\n"
+	return io.MultiReader(
+		strings.NewReader(head),
+		io.LimitReader(zeroReader{}, size),
+		strings.NewReader(tail),
+	), "multipart/form-data; boundary=" + boundary
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// BenchmarkUploadNote sends uploads of growing size to a running gateway.
+// Memory per upload stays flat as the file is streamed to disk:
+//
+//	go test -run '^$' -bench BenchmarkUploadNote -benchmem
+func BenchmarkUploadNote(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			app := newStreamingApp()
+			_, mock := setupTestApp()
+			defer db.Close()
+			app.Post("/api/notes", withUser("user-1"), uploadNote)
+			uploadDir = b.TempDir()
+
+			url := serveApp(b, app) + "/api/notes"
+
+			now := time.Now()
+			for i := 0; i < b.N; i++ {
+				mock.ExpectQuery("INSERT INTO jobs").
+					WillReturnRows(sqlmock.NewRows(jobColumns).
+						AddRow(testJobID, "queued", "", "", "", "lecture.mp3", "audio/mpeg", size, now, nil, nil))
+			}
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				body, contentType := generatedUpload(size)
+				resp, err := http.Post(url, contentType, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusAccepted {
+					b.Fatalf("status %d", resp.StatusCode)
+				}
+			}
+			b.StopTimer()
+			os.RemoveAll(filepath.Join(uploadDir, "user-1"))
+		})
+	}
+}
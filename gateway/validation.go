@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	maxEmailLength = 254
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordLength = 72
+)
+
+//go:embed breached_passwords.txt
+var breachedPasswordList string
+
+var breachedPasswords = parseBreachedPasswords(breachedPasswordList)
+
+// FieldErrors maps request fields to validation messages
+type FieldErrors map[string]string
+
+// PasswordPolicy is the server-side password policy, configurable from
+// the environment
+type PasswordPolicy struct {
+	MinLength     int
+	RequireLetter bool
+	RequireDigit  bool
+	CheckBreached bool
+}
+
+var passwordPolicy = defaultPasswordPolicy()
+
+func defaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:     8,
+		RequireLetter: false,
+		RequireDigit:  false,
+		CheckBreached: true,
+	}
+}
+
+// loadPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE_LETTER,
+// PASSWORD_REQUIRE_DIGIT and PASSWORD_CHECK_BREACHED over the defaults
+func loadPasswordPolicy() (PasswordPolicy, error) {
+	policy := defaultPasswordPolicy()
+
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		minLength, err := strconv.Atoi(value)
+		if err != nil || minLength < 1 || minLength > maxPasswordLength {
+			return policy, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", value)
+		}
+		policy.MinLength = minLength
+	}
+	for name, field := range map[string]*bool{
+		"PASSWORD_REQUIRE_LETTER": &policy.RequireLetter,
+		"PASSWORD_REQUIRE_DIGIT":  &policy.RequireDigit,
+		"PASSWORD_CHECK_BREACHED": &policy.CheckBreached,
+	} {
+		if value := os.Getenv(name); value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return policy, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*field = enabled
+		}
+	}
+	return policy, nil
+}
+
+func parseBreachedPasswords(list string) map[string]struct{} {
+	passwords := make(map[string]struct{})
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = struct{}{}
+	}
+	return passwords
+}
+
+// normalizeEmail trims and case-folds an email so lookups are exact
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateEmail returns a message for an invalid, already normalised email
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email is required"
+	}
+	if len(email) > maxEmailLength {
+		return fmt.Sprintf("Email must be at most %d characters", maxEmailLength)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "Email is not a valid address"
+	}
+	return ""
+}
+
+// validate returns a message when the password violates the policy
+func (p PasswordPolicy) validate(password, email string) string {
+	if password == "" {
+		return "Password is required"
+	}
+	if len(password) < p.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Sprintf("Password must be at most %d bytes", maxPasswordLength)
+	}
+	if p.RequireLetter && !strings.ContainsFunc(password, unicode.IsLetter) {
+		return "Password must contain a letter"
+	}
+	if p.RequireDigit && !strings.ContainsFunc(password, unicode.IsDigit) {
+		return "Password must contain a digit"
+	}
+	if strings.EqualFold(password, email) {
+		return "Password must not match the email"
+	}
+	if p.CheckBreached {
+		if _, breached := breachedPasswords[strings.ToLower(password)]; breached {
+			return "Password appears in a list of breached passwords"
+		}
+	}
+	return ""
+}
+
+// validateSignup normalises the request in place and reports invalid fields
+func validateSignup(req *SignupRequest) FieldErrors {
+	req.Email = normalizeEmail(req.Email)
+
+	errs := FieldErrors{}
+	if msg := validateEmail(req.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := passwordPolicy.validate(req.Password, req.Email); msg != "" {
+		errs["password"] = msg
+	}
+	return errs
+}
+
+func validationError(c *fiber.Ctx, errs FieldErrors) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error":  "Validation failed",
+		"fields": errs,
+	})
+}
+
+// Nullable tells a JSON field that is absent from one that is null, which
+// update requests use to clear a value
+type Nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (n *Nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	n.Value = &value
+	return nil
+}
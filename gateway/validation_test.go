@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	assert.Equal(t, "ada@example.com", normalizeEmail("  Ada@Example.COM \n"))
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"ada@example.com", true},
+		{"ada+notes@uni.example.edu", true},
+		{"", false},
+		{"ada", false},
+		{"ada@", false},
+		{"Ada Lovelace <ada@example.com>", false},
+		{"a@" + string(make([]byte, maxEmailLength)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			assert.Equal(t, tt.valid, validateEmail(tt.email) == "")
+		})
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 10, RequireLetter: true, RequireDigit: true, CheckBreached: true}
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		msg      string
+	}{
+		{"empty", defaultPasswordPolicy(), "", "Password is required"},
+		{"too short", defaultPasswordPolicy(), "x", "Password must be at least 8 characters"},
+		{"too long", defaultPasswordPolicy(), string(make([]byte, 73)), "Password must be at most 72 bytes"},
+		{"breached", defaultPasswordPolicy(), "Password123", "Password appears in a list of breached passwords"},
+		{"matches email", defaultPasswordPolicy(), "ada@example.com", "Password must not match the email"},
+		{"valid", defaultPasswordPolicy(), "purple staple lecture", ""},
+		{"needs digit", strict, "purple staple lecture", "Password must contain a digit"},
+		{"needs letter", strict, "4815162342", "Password must contain a letter"},
+		{"strict valid", strict, "purple staple 42", ""},
+		{"breach check disabled", PasswordPolicy{MinLength: 8}, "password123", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.msg, tt.policy.validate(tt.password, "ada@example.com"))
+		})
+	}
+}
+
+func TestLoadPasswordPolicy(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_REQUIRE_DIGIT", "true")
+	t.Setenv("PASSWORD_CHECK_BREACHED", "false")
+
+	policy, err := loadPasswordPolicy()
+	require.NoError(t, err)
+	assert.Equal(t, PasswordPolicy{MinLength: 12, RequireDigit: true}, policy)
+
+	t.Setenv("PASSWORD_MIN_LENGTH", "zero")
+	_, err = loadPasswordPolicy()
+	assert.Error(t, err)
+}
+
+func TestBreachedPasswordsBundled(t *testing.T) {
+	assert.Contains(t, breachedPasswords, "password")
+	assert.NotContains(t, breachedPasswords, "")
+	for password := range breachedPasswords {
+		assert.NotEqual(t, '#', rune(password[0]))
+	}
+}
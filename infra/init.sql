@@ -9,35 +9,233 @@ CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     email TEXT UNIQUE NOT NULL,
     hashed_password TEXT NOT NULL,
+    email_verified_at TIMESTAMPTZ,
+    totp_secret TEXT,
+    totp_enabled_at TIMESTAMPTZ,
+    totp_last_step BIGINT,
+    role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'admin')),
+    disabled_at TIMESTAMPTZ,
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
 CREATE TABLE IF NOT EXISTS sessions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID REFERENCES users(id),
-    token TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    refresh_token_hash TEXT NOT NULL,
+    family_id UUID NOT NULL,
     expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ,
+    mfa_pending BOOLEAN NOT NULL DEFAULT FALSE,
+    user_agent TEXT,
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS sessions_token_hash_idx ON sessions(token_hash);
+CREATE UNIQUE INDEX IF NOT EXISTS sessions_refresh_token_hash_idx ON sessions(refresh_token_hash);
+CREATE INDEX IF NOT EXISTS sessions_family_id_idx ON sessions(family_id);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_audit (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    user_agent TEXT,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_audit_email_idx ON login_audit(email, created_at);
+CREATE INDEX IF NOT EXISTS login_audit_ip_address_idx ON login_audit(ip_address, created_at);
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_tokens_token_hash_idx ON user_tokens(token_hash);
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens(user_id, purpose);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS recovery_codes_user_id_code_hash_idx ON recovery_codes(user_id, code_hash);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_key_hash_idx ON api_keys(key_hash);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys(user_id);
+
+CREATE TABLE IF NOT EXISTS notebooks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    exam_date TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS notebooks_user_id_name_idx ON notebooks(user_id, lower(name));
+
 CREATE TABLE IF NOT EXISTS notes (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID REFERENCES users(id),
-    title TEXT,
+    notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL,
+    title TEXT NOT NULL DEFAULT '',
     content TEXT,
     summary TEXT,
     created_at TIMESTAMPTZ DEFAULT NOW(),
-    updated_at TIMESTAMPTZ DEFAULT NOW()
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    search_vector tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(summary, '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(content, '')), 'C')
+    ) STORED
+);
+
+CREATE INDEX IF NOT EXISTS notes_user_id_idx ON notes(user_id);
+CREATE INDEX IF NOT EXISTS notes_user_id_created_at_idx ON notes(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_id_updated_at_idx ON notes(user_id, updated_at, id);
+CREATE INDEX IF NOT EXISTS notes_user_id_title_idx ON notes(user_id, title, id);
+CREATE INDEX IF NOT EXISTS notes_search_vector_idx ON notes USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS notes_notebook_id_idx ON notes(notebook_id);
+
+CREATE OR REPLACE FUNCTION update_updated_at_column()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = CURRENT_TIMESTAMP;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS update_notes_updated_at ON notes;
+CREATE TRIGGER update_notes_updated_at
+    BEFORE UPDATE ON notes
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+DROP TRIGGER IF EXISTS update_notebooks_updated_at ON notebooks;
+CREATE TRIGGER update_notebooks_updated_at
+    BEFORE UPDATE ON notebooks
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE IF NOT EXISTS note_revisions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    note_id UUID NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    title TEXT,
+    content TEXT,
+    summary TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (note_id, revision)
+);
+
+CREATE OR REPLACE FUNCTION record_note_revision()
+RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO note_revisions (note_id, revision, title, content, summary)
+    VALUES (
+        NEW.id,
+        COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = NEW.id), 0) + 1,
+        NEW.title,
+        NEW.content,
+        NEW.summary
+    );
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS record_note_revision_insert ON notes;
+CREATE TRIGGER record_note_revision_insert
+    AFTER INSERT ON notes
+    FOR EACH ROW
+    EXECUTE FUNCTION record_note_revision();
+
+DROP TRIGGER IF EXISTS record_note_revision_update ON notes;
+CREATE TRIGGER record_note_revision_update
+    AFTER UPDATE OF title, content, summary ON notes
+    FOR EACH ROW
+    WHEN (OLD.title IS DISTINCT FROM NEW.title
+        OR OLD.content IS DISTINCT FROM NEW.content
+        OR OLD.summary IS DISTINCT FROM NEW.summary)
+    EXECUTE FUNCTION record_note_revision();
+
+CREATE OR REPLACE FUNCTION forbid_note_revision_update()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'note_revisions is append-only';
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS note_revisions_append_only ON note_revisions;
+CREATE TRIGGER note_revisions_append_only
+    BEFORE UPDATE ON note_revisions
+    FOR EACH ROW
+    EXECUTE FUNCTION forbid_note_revision_update();
+
+CREATE TABLE IF NOT EXISTS note_files (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    note_id UUID NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+CREATE INDEX IF NOT EXISTS note_files_note_id_idx ON note_files(note_id);
+CREATE INDEX IF NOT EXISTS note_files_user_id_idx ON note_files(user_id);
+
 CREATE TABLE IF NOT EXISTS ocr_blocks (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     note_id UUID REFERENCES notes(id),
     text TEXT,
     bbox JSONB,
-    created_at TIMESTAMPTZ DEFAULT NOW()
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    search_vector tsvector GENERATED ALWAYS AS (to_tsvector('english', coalesce(text, ''))) STORED
 );
 
+CREATE INDEX IF NOT EXISTS ocr_blocks_note_id_idx ON ocr_blocks(note_id);
+CREATE INDEX IF NOT EXISTS ocr_blocks_search_vector_idx ON ocr_blocks USING GIN (search_vector);
+
 CREATE TABLE IF NOT EXISTS audio_notes (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     note_id UUID REFERENCES notes(id),
@@ -45,21 +243,33 @@ CREATE TABLE IF NOT EXISTS audio_notes (
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+CREATE INDEX IF NOT EXISTS audio_notes_note_id_idx ON audio_notes(note_id);
+
 CREATE TABLE IF NOT EXISTS quiz_cards (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     note_id UUID REFERENCES notes(id),
     question TEXT,
     answer TEXT,
-    created_at TIMESTAMPTZ DEFAULT NOW()
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    search_vector tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(question, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(answer, '')), 'B')
+    ) STORED
 );
 
+CREATE INDEX IF NOT EXISTS quiz_cards_search_vector_idx ON quiz_cards USING GIN (search_vector);
+
 CREATE TABLE IF NOT EXISTS tags (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    note_id UUID REFERENCES notes(id),
-    tag TEXT,
+    note_id UUID NOT NULL REFERENCES notes(id),
+    tag TEXT NOT NULL,
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+CREATE INDEX IF NOT EXISTS tags_note_id_idx ON tags(note_id);
+CREATE UNIQUE INDEX IF NOT EXISTS tags_note_id_tag_idx ON tags(note_id, tag);
+CREATE INDEX IF NOT EXISTS tags_tag_idx ON tags(tag);
+
 CREATE TABLE IF NOT EXISTS study_blocks (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id),
@@ -73,4 +283,53 @@ CREATE TABLE IF NOT EXISTS study_blocks (
 
 CREATE INDEX IF NOT EXISTS study_blocks_user_id_idx ON study_blocks(user_id);
 CREATE INDEX IF NOT EXISTS study_blocks_note_id_idx ON study_blocks(note_id);
-CREATE INDEX IF NOT EXISTS study_blocks_start_time_idx ON study_blocks(start_time); 
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS study_blocks_start_time_idx ON study_blocks(start_time); 
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL,
+    status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'failed')),
+    stage TEXT CHECK (stage IN ('ocr', 'asr', 'summarise', 'qa')),
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    note_id UUID REFERENCES notes(id) ON DELETE SET NULL,
+    error TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS jobs_user_id_idx ON jobs(user_id);
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs(created_at) WHERE status IN ('queued', 'running');
+
+CREATE TABLE IF NOT EXISTS job_events (
+    id BIGSERIAL PRIMARY KEY,
+    job_id UUID NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS job_events_job_id_idx ON job_events(job_id, id);
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notebook_id UUID REFERENCES notebooks(id) ON DELETE SET NULL,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL CHECK (size_bytes > 0),
+    offset_bytes BIGINT NOT NULL DEFAULT 0 CHECK (offset_bytes BETWEEN 0 AND size_bytes),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    claim_token UUID,
+    claimed_until TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS uploads_user_id_idx ON uploads(user_id, expires_at);
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads(expires_at);
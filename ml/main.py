@@ -10,7 +10,7 @@ from ocr_service import extract_layout
 from asr_service import transcribe
 from summarise_service import summarise
 from qg_service import generate_qa
-from pipeline import process_note
+from pipeline import process_note, extract_keyphrases
 
 app = FastAPI()
 
@@ -53,6 +53,13 @@ class QAPair(BaseModel):
 class QAResponse(BaseModel):
     qa_pairs: List[QAPair]
 
+class KeyphraseRequest(BaseModel):
+    text: str
+    top_n: int = 5
+
+class KeyphraseResponse(BaseModel):
+    keyphrases: List[str]
+
 class PipelineResponse(BaseModel):
     note_id: str
 
@@ -101,6 +108,11 @@ async def generate_qa_endpoint(request: QARequest) -> QAResponse:
     qa_pairs = generate_qa(request.text, request.max_questions)
     return QAResponse(qa_pairs=qa_pairs)
 
+# Keyphrase Endpoint, the tags of a note
+@app.post("/keyphrases", response_model=KeyphraseResponse)
+async def keyphrases_endpoint(request: KeyphraseRequest) -> KeyphraseResponse:
+    return KeyphraseResponse(keyphrases=extract_keyphrases(request.text, request.top_n))
+
 # Pipeline Endpoint
 @app.post("/pipeline", response_model=PipelineResponse)
 async def pipeline_endpoint(
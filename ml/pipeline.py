@@ -111,12 +111,13 @@ async def process_note(file: UploadFile) -> Dict[str, str]:
                     VALUES (%s, %s, %s)
                 """, (note_id, qa['q'], qa['a']))
             
-            # Insert tags
+            # Insert tags, normalised the way the gateway stores them
             for tag in tags:
                 cur.execute("""
                     INSERT INTO tags (note_id, tag)
                     VALUES (%s, %s)
-                """, (note_id, tag))
+                    ON CONFLICT (note_id, tag) DO NOTHING
+                """, (note_id, ' '.join(tag.split()).lower()))
         
         conn.commit()
     